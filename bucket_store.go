@@ -0,0 +1,30 @@
+package bloom
+
+// BucketStore is the backing storage for the buckets of an ibf. The default store is an in-memory slice, custom
+// backends (e.g. a memory-mapped file for filters that do not fit on the heap) can be used with NewIbfWithStore.
+//
+// The ibf always writes a bucket back with Set after modifying it, so Get may return a copy of the stored bucket, e.g.
+// one created with NewBucket from a serialized bucket. Implementations are not required to be safe for concurrent use.
+type BucketStore interface {
+	// Get returns the bucket at index idx, 0 <= idx < Len().
+	Get(idx int) *Bucket
+	// Set stores the bucket at index idx, 0 <= idx < Len().
+	Set(idx int, b *Bucket)
+	// Len returns the number of buckets in the store. It must not change during the lifetime of the store.
+	Len() int
+}
+
+// sliceStore is the default in-memory BucketStore
+type sliceStore []*Bucket
+
+func (s sliceStore) Get(idx int) *Bucket {
+	return s[idx]
+}
+
+func (s sliceStore) Set(idx int, b *Bucket) {
+	s[idx] = b
+}
+
+func (s sliceStore) Len() int {
+	return len(s)
+}
@@ -0,0 +1,64 @@
+package bloom_test
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/gerardsn/bloom"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// byteStore serializes the buckets in a flat byte slice, like a memory-mapped backend outside of the package would
+type byteStore struct {
+	data      []byte
+	keyLength int
+}
+
+func newByteStore(numBuckets, keyLength int) *byteStore {
+	return &byteStore{data: make([]byte, numBuckets*(keyLength+16)), keyLength: keyLength}
+}
+
+func (s *byteStore) record(idx int) []byte {
+	size := s.keyLength + 16
+	return s.data[idx*size : (idx+1)*size]
+}
+
+func (s *byteStore) Get(idx int) *bloom.Bucket {
+	r := s.record(idx)
+	count := int(int64(binary.LittleEndian.Uint64(r)))
+	keySum := append([]byte{}, r[8:8+s.keyLength]...)
+	return bloom.NewBucket(count, keySum, binary.LittleEndian.Uint64(r[8+s.keyLength:]))
+}
+
+func (s *byteStore) Set(idx int, b *bloom.Bucket) {
+	r := s.record(idx)
+	binary.LittleEndian.PutUint64(r, uint64(b.Count()))
+	copy(r[8:8+s.keyLength], b.KeySum())
+	binary.LittleEndian.PutUint64(r[8+s.keyLength:], b.HashSum())
+}
+
+func (s *byteStore) Len() int {
+	return len(s.data) / (s.keyLength + 16)
+}
+
+func TestNewIbfWithStore_external(t *testing.T) {
+	numBuckets := 128
+	local, remote := bloom.NewIbfWithStore(newByteStore(numBuckets, 32)), bloom.NewIbf(numBuckets)
+	var expRemaining, expMissing [][]byte
+	for n := 0; n < 20; n++ {
+		a, b := make([]byte, 32), make([]byte, 32)
+		rand.Read(a)
+		rand.Read(b)
+		assert.NoError(t, local.Add(a))
+		assert.NoError(t, remote.Add(b))
+		expRemaining = append(expRemaining, a)
+		expMissing = append(expMissing, b)
+	}
+
+	assert.NoError(t, local.Subtract(remote))
+	remaining, missing, err := local.Decode()
+
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, expRemaining, remaining)
+	assert.ElementsMatch(t, expMissing, missing)
+}
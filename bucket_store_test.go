@@ -0,0 +1,54 @@
+package bloom
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// copyStore mimics an external backend that does not hand out references to its stored buckets
+type copyStore struct {
+	buckets map[int]Bucket
+	size    int
+}
+
+func (s *copyStore) Get(idx int) *Bucket {
+	b := s.buckets[idx]
+	b.keySum = append([]byte{}, b.keySum...)
+	return &b
+}
+
+func (s *copyStore) Set(idx int, b *Bucket) {
+	s.buckets[idx] = Bucket{count: b.count, keySum: append([]byte{}, b.keySum...), hashSum: b.hashSum}
+}
+
+func (s *copyStore) Len() int {
+	return s.size
+}
+
+func TestNewIbfWithStore(t *testing.T) {
+	numBuckets := 128
+	ibfA, ibfB := NewIbfWithStore(&copyStore{buckets: map[int]Bucket{}, size: numBuckets}), NewIbf(numBuckets)
+	var expRemaining, expMissing [][]byte
+	for n := 0; n < 40; n++ {
+		a, b := generateData(), generateData()
+		ibfA.Add(a)
+		ibfB.Add(b)
+		if n%2 == 0 {
+			ibfB.Add(a)
+			expMissing = append(expMissing, b)
+		} else {
+			ibfA.Add(b)
+			expRemaining = append(expRemaining, a)
+		}
+	}
+
+	assert.NoError(t, ibfA.Subtract(ibfB))
+	remaining, missing, err := ibfA.Decode()
+
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, expRemaining, remaining)
+	assert.ElementsMatch(t, expMissing, missing)
+	for idx := 0; idx < numBuckets; idx++ {
+		assert.True(t, ibfA.Buckets.Get(idx).isEmpty(), "bucket %d not empty after decoding", idx)
+	}
+}
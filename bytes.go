@@ -33,6 +33,13 @@ func xor(a, b []byte) []byte {
 	return r
 }
 
+// xorInto stores a xor b in dst, which may be a or b
+func xorInto(dst, a, b []byte) {
+	for i := range a {
+		dst[i] = a[i] ^ b[i]
+	}
+}
+
 // eq
 func eq(a, b []byte) bool {
 	if len(a) != len(b) {
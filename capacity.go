@@ -0,0 +1,126 @@
+package bloom
+
+import (
+	"math/rand"
+)
+
+const (
+	// MinBuckets is the smallest number of buckets of the capacity table and of recommended filter sizes.
+	MinBuckets = 16
+	// capacityTrials is the number of filters decoded by CapacityTable for every candidate difference size
+	capacityTrials = 100
+	// capacitySuccessRate is the decode success rate a difference size must reach to fit the capacity
+	capacitySuccessRate = 0.99
+)
+
+// CapacityRow reports the largest difference that decodes with a success rate of at least 99% in a filter with
+// Buckets buckets.
+type CapacityRow struct {
+	Buckets       int
+	MaxDifference int
+}
+
+// capacityTable is the output of CapacityTable(1 << 16) for the default parameters of NewIbf.
+var capacityTable = []CapacityRow{
+	{Buckets: 16, MaxDifference: 8},
+	{Buckets: 32, MaxDifference: 15},
+	{Buckets: 64, MaxDifference: 35},
+	{Buckets: 128, MaxDifference: 82},
+	{Buckets: 256, MaxDifference: 178},
+	{Buckets: 512, MaxDifference: 371},
+	{Buckets: 1024, MaxDifference: 752},
+	{Buckets: 2048, MaxDifference: 1534},
+	{Buckets: 4096, MaxDifference: 3096},
+	{Buckets: 8192, MaxDifference: 6237},
+	{Buckets: 16384, MaxDifference: 12536},
+	{Buckets: 32768, MaxDifference: 25120},
+	{Buckets: 65536, MaxDifference: 50316},
+}
+
+// DecodeSuccessRate returns the fraction of trials in which a filter with numBuckets buckets and the default
+// parameters of NewIbf decodes a difference of diffSize random keys. The keys are generated from a fixed seed, so the
+// result is deterministic.
+func DecodeSuccessRate(numBuckets, diffSize, trials int) float64 {
+	r := rand.New(rand.NewSource(int64(numBuckets)<<32 | int64(diffSize)))
+	successes := 0
+	for trial := 0; trial < trials; trial++ {
+		filter := NewIbf(numBuckets)
+		for n := 0; n < diffSize; n++ {
+			key := make([]byte, keyLength)
+			r.Read(key)
+			filter.Add(key)
+		}
+		if _, _, err := filter.Decode(); err == nil {
+			successes++
+		}
+	}
+	return float64(successes) / float64(trials)
+}
+
+// CapacityTable measures the capacity of filters with MinBuckets up to maxBuckets buckets, doubling the number of
+// buckets on every row. The capacity of a row is found by a binary search over DecodeSuccessRate, which makes this
+// expensive for large filters.
+func CapacityTable(maxBuckets int) []CapacityRow {
+	var table []CapacityRow
+	// capacity does not shrink with the number of buckets, so every search starts at the previous capacity
+	low := 0
+	for numBuckets := MinBuckets; numBuckets <= maxBuckets; numBuckets *= 2 {
+		// invariant: low decodes, high does not
+		high := numBuckets
+		for high-low > 1 {
+			mid := (low + high) / 2
+			if DecodeSuccessRate(numBuckets, mid, capacityTrials) >= capacitySuccessRate {
+				low = mid
+			} else {
+				high = mid
+			}
+		}
+		table = append(table, CapacityRow{Buckets: numBuckets, MaxDifference: low})
+	}
+	return table
+}
+
+// RecommendedBuckets returns the number of buckets that decodes a difference of diffSize keys with a success rate of
+// at least 99%, looked up in the capacity table. Beyond the table, the number of buckets grows linearly at the ratio of
+// its last row.
+func RecommendedBuckets(diffSize int) int {
+	for _, row := range capacityTable {
+		if diffSize <= row.MaxDifference {
+			return row.Buckets
+		}
+	}
+	last := capacityTable[len(capacityTable)-1]
+	return (diffSize*last.Buckets + last.MaxDifference - 1) / last.MaxDifference
+}
+
+// DecodeCapacity returns the approximate size of the largest difference the filter decodes with a success rate of at
+// least 99%. It is interpolated from the capacity table, which is measured for K = 4, and scaled by the peeling
+// threshold of K for other values. Compare it with an estimate of the difference to skip reconciliation attempts that
+// are bound to fail.
+func (i *ibf) DecodeCapacity() int {
+	numBuckets := i.Buckets.Len()
+	capacity := 0.
+	first, last := capacityTable[0], capacityTable[len(capacityTable)-1]
+	switch {
+	case numBuckets <= first.Buckets:
+		capacity = float64(first.MaxDifference*numBuckets) / float64(first.Buckets)
+	case numBuckets >= last.Buckets:
+		capacity = float64(last.MaxDifference*numBuckets) / float64(last.Buckets)
+	default:
+		for idx := 1; idx < len(capacityTable); idx++ {
+			low, high := capacityTable[idx-1], capacityTable[idx]
+			if numBuckets <= high.Buckets {
+				fraction := float64(numBuckets-low.Buckets) / float64(high.Buckets-low.Buckets)
+				capacity = float64(low.MaxDifference) + fraction*float64(high.MaxDifference-low.MaxDifference)
+				break
+			}
+		}
+	}
+	if k := i.K; k != 4 {
+		if k >= len(peelThresholds) {
+			k = len(peelThresholds) - 1
+		}
+		capacity *= peelThresholds[k] / peelThresholds[4]
+	}
+	return int(capacity)
+}
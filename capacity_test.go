@@ -0,0 +1,70 @@
+package bloom
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func TestCapacityTable(t *testing.T) {
+	table := CapacityTable(512)
+
+	assert.Len(t, table, 6)
+	assert.Equal(t, CapacityRow{Buckets: MinBuckets, MaxDifference: table[0].MaxDifference}, table[0])
+	for idx := 1; idx < len(table); idx++ {
+		assert.Greater(t, table[idx].Buckets, table[idx-1].Buckets)
+		assert.Greater(t, table[idx].MaxDifference, table[idx-1].MaxDifference)
+	}
+	assert.Equal(t, capacityTable[:len(table)], table)
+}
+
+func TestDecodeSuccessRate(t *testing.T) {
+	assert.Equal(t, 1.0, DecodeSuccessRate(64, 0, 10))
+	assert.Equal(t, 0.0, DecodeSuccessRate(64, 64, 10))
+	assert.Equal(t, DecodeSuccessRate(64, 20, 10), DecodeSuccessRate(64, 20, 10), "deterministic")
+}
+
+func TestRecommendedBuckets(t *testing.T) {
+	last := capacityTable[len(capacityTable)-1]
+
+	assert.Equal(t, MinBuckets, RecommendedBuckets(0))
+	assert.Equal(t, capacityTable[3].Buckets, RecommendedBuckets(capacityTable[3].MaxDifference))
+	assert.Equal(t, capacityTable[4].Buckets, RecommendedBuckets(capacityTable[3].MaxDifference+1))
+	assert.Equal(t, 2*last.Buckets, RecommendedBuckets(2*last.MaxDifference))
+}
+
+func TestIbf_DecodeCapacity(t *testing.T) {
+	for _, row := range capacityTable {
+		assert.Equal(t, row.MaxDifference, NewIbf(row.Buckets).DecodeCapacity())
+	}
+	assert.Less(t, NewIbf(100).DecodeCapacity(), NewIbf(200).DecodeCapacity())
+	assert.Less(t, NewIbf(200).DecodeCapacity(), NewIbf(300).DecodeCapacity())
+	assert.Greater(t, NewIbf(300).DecodeCapacity(), capacityTable[4].MaxDifference)
+	assert.Equal(t, 2*capacityTable[len(capacityTable)-1].MaxDifference, NewIbf(2*capacityTable[len(capacityTable)-1].Buckets).DecodeCapacity())
+
+	t.Run("differences below capacity decode", func(t *testing.T) {
+		filter := NewIbf(300)
+		// fixed seed, random keys occasionally fail more than the expected 1% of the trials
+		r := rand.New(rand.NewSource(300))
+		failures := 0
+		for trial := 0; trial < 50; trial++ {
+			c := filter.clone()
+			for n := 0; n < filter.DecodeCapacity(); n++ {
+				key := make([]byte, keyLength)
+				r.Read(key)
+				c.Add(key)
+			}
+			if _, _, err := c.Decode(); err != nil {
+				failures++
+			}
+		}
+		assert.LessOrEqual(t, failures, 3)
+	})
+
+	t.Run("K", func(t *testing.T) {
+		filter := NewIbf(256)
+		filter.K = 3
+
+		assert.Greater(t, filter.DecodeCapacity(), NewIbf(256).DecodeCapacity())
+	})
+}
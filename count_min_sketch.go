@@ -0,0 +1,62 @@
+package bloom
+
+import (
+	"github.com/spaolacci/murmur3"
+)
+
+// CountMinSketch estimates the frequency of keys. Estimates never underestimate the true frequency, and exceed it by at
+// most e/width times the total count with probability 1 - e^-depth.
+// Like the ibf, a key is hashed once with murmur3 and the xorshift64 chain of the hash selects the counter in each row.
+type CountMinSketch struct {
+	seed   uint32
+	width  int
+	counts [][]uint64
+}
+
+// NewCountMinSketch creates a sketch with depth rows of width counters. The sketch has at least one row of one counter.
+func NewCountMinSketch(width, depth int) *CountMinSketch {
+	if width < 1 {
+		width = 1
+	}
+	if depth < 1 {
+		depth = 1
+	}
+	counts := make([][]uint64, depth)
+	for row := range counts {
+		counts[row] = make([]uint64, width)
+	}
+	return &CountMinSketch{
+		seed:   uint32(33),
+		width:  width,
+		counts: counts,
+	}
+}
+
+// Add increases the frequency of the key by n.
+func (c *CountMinSketch) Add(key []byte, n uint64) {
+	for row, idx := range c.indices(key) {
+		c.counts[row][idx] += n
+	}
+}
+
+// Estimate returns the estimated frequency of the key.
+func (c *CountMinSketch) Estimate(key []byte) uint64 {
+	var estimate uint64
+	for row, idx := range c.indices(key) {
+		if row == 0 || c.counts[row][idx] < estimate {
+			estimate = c.counts[row][idx]
+		}
+	}
+	return estimate
+}
+
+// indices returns the index of the key's counter in each row
+func (c *CountMinSketch) indices(key []byte) []uint64 {
+	indices := make([]uint64, len(c.counts))
+	next := xorshift64(murmur3.Sum64WithSeed(key, c.seed))
+	for row := range indices {
+		indices[row] = next % uint64(c.width)
+		next = xorshift64(next)
+	}
+	return indices
+}
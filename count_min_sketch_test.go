@@ -0,0 +1,50 @@
+package bloom
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCountMinSketch(t *testing.T) {
+	sketch := NewCountMinSketch(1024, 4)
+	frequencies := map[string]uint64{}
+	for n := 0; n < 100; n++ {
+		key := generateData()
+		frequencies[string(key)] = uint64(n%10 + 1)
+		sketch.Add(key, uint64(n%10+1))
+	}
+
+	exact := 0
+	for key, frequency := range frequencies {
+		estimate := sketch.Estimate([]byte(key))
+		assert.GreaterOrEqual(t, estimate, frequency, "estimate must be an upper bound")
+		assert.LessOrEqual(t, estimate-frequency, uint64(20), "estimate too far off at low load")
+		if estimate == frequency {
+			exact++
+		}
+	}
+	assert.Greater(t, exact, 90, "most estimates should be exact at low load")
+
+	t.Run("unknown key", func(t *testing.T) {
+		assert.Equal(t, uint64(0), NewCountMinSketch(16, 2).Estimate(generateData()))
+	})
+
+	t.Run("accumulates", func(t *testing.T) {
+		sketch := NewCountMinSketch(16, 2)
+		key := generateData()
+		sketch.Add(key, 3)
+		sketch.Add(key, 4)
+		assert.Equal(t, uint64(7), sketch.Estimate(key))
+	})
+
+	t.Run("no counters", func(t *testing.T) {
+		for _, size := range [][2]int{{0, 2}, {16, 0}, {-1, -1}} {
+			sketch := NewCountMinSketch(size[0], size[1])
+			key := generateData()
+
+			sketch.Add(key, 3)
+
+			assert.GreaterOrEqual(t, sketch.Estimate(key), uint64(3), "width %d, depth %d", size[0], size[1])
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package bloom
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrDuplicateKey is returned by a debug ibf when a key is added while it is already present.
+	ErrDuplicateKey = errors.New("key added twice")
+	// ErrKeyNotFound is returned by a debug ibf when a key is deleted that is not present.
+	ErrKeyNotFound = errors.New("deleted key not present")
+)
+
+// debugIbf is an ibf that tracks the hashes of the keys it holds to detect misuse by the caller, such as adding the same
+// key twice or deleting an absent key. It is a development aid: the tracking costs memory and time on every operation.
+// Only Add and Delete are checked, the keys peeled by Decode are not tracked.
+type debugIbf struct {
+	*ibf
+	// inserted holds the hashes of the keys in the filter
+	inserted map[uint64]bool
+}
+
+// NewIbfDebug creates an ibf with numBuckets buckets that errors on duplicate insertions and deletions of absent keys.
+func NewIbfDebug(numBuckets int) *debugIbf {
+	return &debugIbf{
+		ibf:      NewIbf(numBuckets),
+		inserted: map[uint64]bool{},
+	}
+}
+
+func (d *debugIbf) Add(key []byte) error {
+	hash := d.keyHash(key)
+	if d.inserted[hash] {
+		return fmt.Errorf("%w: %x", ErrDuplicateKey, key)
+	}
+	if err := d.ibf.Add(key); err != nil {
+		return err
+	}
+	d.inserted[hash] = true
+	return nil
+}
+
+func (d *debugIbf) Delete(key []byte) error {
+	hash := d.keyHash(key)
+	if !d.inserted[hash] {
+		return fmt.Errorf("%w: %x", ErrKeyNotFound, key)
+	}
+	if err := d.ibf.Delete(key); err != nil {
+		return err
+	}
+	delete(d.inserted, hash)
+	return nil
+}
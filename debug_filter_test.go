@@ -0,0 +1,45 @@
+package bloom
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewIbfDebug(t *testing.T) {
+	key := generateData()
+
+	t.Run("double add", func(t *testing.T) {
+		filter := NewIbfDebug(64)
+		assert.NoError(t, filter.Add(key))
+		exp := filter.clone()
+
+		assert.ErrorIs(t, filter.Add(key), ErrDuplicateKey)
+		assert.True(t, filter.Equals(exp), "filter was modified")
+	})
+
+	t.Run("delete absent key", func(t *testing.T) {
+		filter := NewIbfDebug(64)
+		assert.ErrorIs(t, filter.Delete(key), ErrKeyNotFound)
+
+		assert.NoError(t, filter.Add(key))
+		assert.NoError(t, filter.Delete(key))
+		assert.ErrorIs(t, filter.Delete(key), ErrKeyNotFound)
+	})
+
+	t.Run("decode", func(t *testing.T) {
+		filter := NewIbfDebug(64)
+		assert.NoError(t, filter.Add(key))
+
+		remaining, _, err := filter.Decode()
+
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{key}, remaining)
+	})
+
+	t.Run("non-debug path unaffected", func(t *testing.T) {
+		filter := NewIbf(64)
+		assert.NoError(t, filter.Add(key))
+		assert.NoError(t, filter.Add(key))
+		assert.NoError(t, filter.Delete(generateData()))
+	})
+}
@@ -0,0 +1,439 @@
+package bloom
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const binaryVersion = 3
+
+// byteOrderTag is encoded in the byte order of the encoding to detect it on decoding
+const byteOrderTag uint16 = 0x0102
+
+// flags in the binary header
+const (
+	flagPreserveLength = 1 << iota
+	flagShard
+	flagDoubleHashing
+	flagFNV1a
+	// flagSparse marks the encoding of a sparseIbf
+	flagSparse
+)
+
+// binaryPrefix starts the binary format. It holds the format version, and byteOrderTag in the byte order used by the
+// rest of the encoding.
+type binaryPrefix struct {
+	Version   uint8
+	ByteOrder [2]byte
+}
+
+// binaryHeader follows the binaryPrefix. It is followed by the ShardInfo if flagShard is set, NumLengths
+// lengthEntry's and NumBuckets buckets. A bucket is encoded as its count in countBytes(CountWidth) bytes, the keySum in
+// KeyLength bytes and the hashSum in 8 bytes. If flagSparse is set, the lengths are followed by the number of non-empty
+// buckets in 4 bytes instead, and every non-empty bucket is preceded by its index in sparseIndexBytes.
+type binaryHeader struct {
+	Flags      uint8
+	CountWidth uint8
+	K          uint32
+	Seed       uint32
+	KeyLength  uint32
+	NumBuckets uint32
+	NumLengths uint32
+	Epoch      uint64
+}
+
+type binaryShard struct {
+	Offset       uint32
+	TotalBuckets uint32
+}
+
+type lengthEntry struct {
+	Hash   uint64
+	Length uint32
+}
+
+// MarshalBinary encodes the ibf in a compact binary format. All integers are encoded little-endian regardless of the
+// host, decoding also accepts big-endian encodings as indicated by the byte order tag in the header.
+func (i *ibf) MarshalBinary() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := i.writeBinary(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// TransmitCost returns the length of the encoding of MarshalBinary without encoding the filter. Compare it with the
+// number of keys times KeyLength to choose between reconciliation and sending all keys.
+func (i *ibf) TransmitCost() int {
+	return i.headerBytes() + i.Buckets.Len()*i.bucketBytes()
+}
+
+// UnmarshalBinary replaces the ibf by the filter encoded in data by MarshalBinary.
+func (i *ibf) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	newIbf, numBuckets, order, err := readHeader(r)
+	if err != nil {
+		return err
+	}
+	// check the size before allocating the buckets to protect against crafted headers
+	if r.Len() != numBuckets*newIbf.bucketBytes() {
+		return fmt.Errorf("%w: expected (%d) bytes of Buckets got (%d)", ErrCorruptFilter, numBuckets*newIbf.bucketBytes(), r.Len())
+	}
+	buckets := make(sliceStore, numBuckets)
+	for idx := range buckets {
+		if buckets[idx], err = newIbf.readBucket(r, order); err != nil {
+			return err
+		}
+	}
+	newIbf.Buckets = buckets
+	*i = *newIbf
+	return nil
+}
+
+// SubtractFrom subtracts the filter encoded by MarshalBinary that is read from r, e.g. a network connection, bucket by
+// bucket without buffering the remote filter. The header is validated before any bucket is subtracted. The remote
+// filter is assumed to use the salt of i, since salts are not serialized. If reading a bucket fails or a count
+// overflows, the filter is left partially subtracted and should be discarded.
+func (i *ibf) SubtractFrom(r io.Reader) error {
+	remote, numBuckets, order, err := readHeader(r)
+	if err != nil {
+		return fmt.Errorf("subtraction failed: %w", err)
+	}
+	if numBuckets != i.Buckets.Len() {
+		return fmt.Errorf("subtraction failed: unequal number of Buckets, expected (%d) got (%d)", i.Buckets.Len(), numBuckets)
+	}
+	remote.Salt = i.Salt
+	if err = i.validateParams(remote); err != nil {
+		return fmt.Errorf("subtraction failed: %w", err)
+	}
+	for hash, length := range remote.Lengths {
+		i.Lengths[hash] = length
+	}
+	for idx := 0; idx < numBuckets; idx++ {
+		o, err := remote.readBucket(r, order)
+		if err != nil {
+			return fmt.Errorf("subtraction failed: %w", err)
+		}
+		b := i.Buckets.Get(idx)
+		if !i.countFits(b.count, -o.count) {
+			return fmt.Errorf("subtraction failed: %w in bucket %d", ErrCountOverflow, idx)
+		}
+		b.subtract(o)
+		i.Buckets.Set(idx, b)
+	}
+	return nil
+}
+
+func (i *ibf) writeBinary(w io.Writer) error {
+	return i.writeBinaryOrder(w, binary.LittleEndian)
+}
+
+func (i *ibf) writeBinaryOrder(w io.Writer, order binary.ByteOrder) error {
+	if err := i.writeHeader(w, order, i.Buckets.Len(), 0); err != nil {
+		return err
+	}
+	buf := make([]byte, i.bucketBytes())
+	for idx := 0; idx < i.Buckets.Len(); idx++ {
+		i.encodeBucket(buf, i.Buckets.Get(idx), order)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHeader writes everything up to the buckets for a filter of numBuckets buckets, with the extra flags set.
+func (i *ibf) writeHeader(w io.Writer, order binary.ByteOrder, numBuckets int, flags uint8) error {
+	prefix := binaryPrefix{Version: binaryVersion}
+	order.PutUint16(prefix.ByteOrder[:], byteOrderTag)
+	if err := binary.Write(w, order, prefix); err != nil {
+		return err
+	}
+	header := binaryHeader{
+		Flags:      flags,
+		CountWidth: uint8(i.CountWidth),
+		K:          uint32(i.K),
+		Seed:       uint32(i.Seed),
+		KeyLength:  uint32(i.KeyLength),
+		NumBuckets: uint32(numBuckets),
+		NumLengths: uint32(len(i.Lengths)),
+		Epoch:      i.epoch,
+	}
+	if i.PreserveLength {
+		header.Flags |= flagPreserveLength
+	}
+	if i.Shard != nil {
+		header.Flags |= flagShard
+	}
+	if i.IndexFunc == IndexDoubleHashing {
+		header.Flags |= flagDoubleHashing
+	}
+	if i.HashFunc == HashFNV1a {
+		header.Flags |= flagFNV1a
+	}
+	if err := binary.Write(w, order, header); err != nil {
+		return err
+	}
+	if i.Shard != nil {
+		shard := binaryShard{Offset: uint32(i.Shard.Offset), TotalBuckets: uint32(i.Shard.TotalBuckets)}
+		if err := binary.Write(w, order, shard); err != nil {
+			return err
+		}
+	}
+	for hash, length := range i.Lengths {
+		if err := binary.Write(w, order, lengthEntry{Hash: hash, Length: uint32(length)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// headerBytes returns the size of the encoding written by writeHeader.
+func (i *ibf) headerBytes() int {
+	size := binary.Size(binaryPrefix{}) + binary.Size(binaryHeader{})
+	if i.Shard != nil {
+		size += binary.Size(binaryShard{})
+	}
+	return size + len(i.Lengths)*binary.Size(lengthEntry{})
+}
+
+// readHeader reads everything up to the buckets of a dense encoding. It returns an ibf without buckets, the number of
+// buckets that follow and the byte order of the encoding.
+func readHeader(r io.Reader) (*ibf, int, binary.ByteOrder, error) {
+	newIbf, numBuckets, order, flags, err := readHeaderFlags(r)
+	if err == nil && flags&flagSparse != 0 {
+		return nil, 0, nil, fmt.Errorf("%w: sparse encoding, decode it with the sparse filter", ErrCorruptFilter)
+	}
+	return newIbf, numBuckets, order, err
+}
+
+// readHeaderFlags reads the header of a dense or sparse encoding like readHeader, and returns its flags.
+func readHeaderFlags(r io.Reader) (*ibf, int, binary.ByteOrder, uint8, error) {
+	var prefix binaryPrefix
+	if err := binary.Read(r, binary.LittleEndian, &prefix); err != nil {
+		return nil, 0, nil, 0, fmt.Errorf("%w: %v", ErrCorruptFilter, err)
+	}
+	if prefix.Version != binaryVersion {
+		return nil, 0, nil, 0, fmt.Errorf("unsupported binary version (%d)", prefix.Version)
+	}
+	var order binary.ByteOrder
+	switch byteOrderTag {
+	case binary.LittleEndian.Uint16(prefix.ByteOrder[:]):
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint16(prefix.ByteOrder[:]):
+		order = binary.BigEndian
+	default:
+		return nil, 0, nil, 0, fmt.Errorf("%w: unknown byte order tag (%x)", ErrCorruptFilter, prefix.ByteOrder)
+	}
+	var header binaryHeader
+	if err := binary.Read(r, order, &header); err != nil {
+		return nil, 0, nil, 0, fmt.Errorf("%w: %v", ErrCorruptFilter, err)
+	}
+	newIbf := &ibf{
+		Buckets:        sliceStore{},
+		K:              int(header.K),
+		Seed:           Seed(header.Seed),
+		KeyLength:      int(header.KeyLength),
+		PreserveLength: header.Flags&flagPreserveLength != 0,
+		Lengths:        map[uint64]int{},
+		CountWidth:     int(header.CountWidth),
+		epoch:          header.Epoch,
+	}
+	if header.Flags&flagDoubleHashing != 0 {
+		newIbf.IndexFunc = IndexDoubleHashing
+	}
+	if header.Flags&flagFNV1a != 0 {
+		newIbf.HashFunc = HashFNV1a
+	}
+	if header.K < 1 || header.K > header.NumBuckets || header.KeyLength < 1 || header.KeyLength > MaxKeyLength || header.CountWidth > 64 {
+		return nil, 0, nil, 0, fmt.Errorf("%w: invalid header", ErrCorruptFilter)
+	}
+	if header.Flags&flagShard != 0 {
+		var shard binaryShard
+		if err := binary.Read(r, order, &shard); err != nil {
+			return nil, 0, nil, 0, fmt.Errorf("%w: %v", ErrCorruptFilter, err)
+		}
+		newIbf.Shard = &ShardInfo{Offset: int(shard.Offset), TotalBuckets: int(shard.TotalBuckets)}
+	}
+	for n := uint32(0); n < header.NumLengths; n++ {
+		var entry lengthEntry
+		if err := binary.Read(r, order, &entry); err != nil {
+			return nil, 0, nil, 0, fmt.Errorf("%w: %v", ErrCorruptFilter, err)
+		}
+		if entry.Length > header.KeyLength {
+			return nil, 0, nil, 0, fmt.Errorf("%w: key length (%d) exceeds KeyLength", ErrCorruptFilter, entry.Length)
+		}
+		newIbf.Lengths[entry.Hash] = int(entry.Length)
+	}
+	return newIbf, int(header.NumBuckets), order, header.Flags, nil
+}
+
+func (i *ibf) readBucket(r io.Reader, order binary.ByteOrder) (*Bucket, error) {
+	buf := make([]byte, i.bucketBytes())
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptFilter, err)
+	}
+	return i.decodeBucket(buf, order)
+}
+
+// bucketBytes returns the size of an encoded bucket.
+func (i *ibf) bucketBytes() int {
+	return countBytes(i.CountWidth) + i.KeyLength + 8
+}
+
+// countBytes returns the number of bytes used to encode a count of the given width.
+func countBytes(countWidth int) int {
+	switch {
+	case countWidth == 0 || countWidth > 32:
+		return 8
+	case countWidth > 16:
+		return 4
+	case countWidth > 8:
+		return 2
+	default:
+		return 1
+	}
+}
+
+func (i *ibf) encodeBucket(buf []byte, b *Bucket, order binary.ByteOrder) {
+	n := countBytes(i.CountWidth)
+	var count [8]byte
+	// the count is truncated to its n least significant bytes
+	order.PutUint64(count[:], uint64(int64(b.count)))
+	if order == binary.BigEndian {
+		copy(buf[:n], count[8-n:])
+	} else {
+		copy(buf[:n], count[:n])
+	}
+	copy(buf[n:], b.keySum)
+	order.PutUint64(buf[n+i.KeyLength:], b.hashSum)
+}
+
+func (i *ibf) decodeBucket(buf []byte, order binary.ByteOrder) (*Bucket, error) {
+	n := countBytes(i.CountWidth)
+	var count [8]byte
+	if order == binary.BigEndian {
+		copy(count[8-n:], buf[:n])
+	} else {
+		copy(count[:n], buf[:n])
+	}
+	// sign extend the two's complement count
+	shift := 64 - 8*n
+	b := &Bucket{
+		count:   int(int64(order.Uint64(count[:])<<shift) >> shift),
+		keySum:  append([]byte{}, buf[n:n+i.KeyLength]...),
+		hashSum: order.Uint64(buf[n+i.KeyLength:]),
+	}
+	if low, high := i.countBounds(); b.count < low || b.count > high {
+		return nil, fmt.Errorf("%w: count (%d) exceeds CountWidth", ErrCorruptFilter, b.count)
+	}
+	return b, nil
+}
+
+// Codec selects the compression of MarshalCompressed. Only codecs of the standard library are supported to keep the
+// package free of extra dependencies.
+type Codec uint8
+
+const (
+	CodecNone Codec = iota
+	CodecGzip
+	CodecFlate
+)
+
+// MarshalCompressed encodes the ibf in the binary format and compresses it with the codec. The result starts with a
+// one-byte codec tag, so UnmarshalCompressed does not need to know the codec. Mostly empty (e.g. subtracted) filters
+// compress extremely well.
+func (i *ibf) MarshalCompressed(codec Codec) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(byte(codec))
+	var w io.WriteCloser
+	var err error
+	switch codec {
+	case CodecNone:
+		if err = i.writeBinary(buf); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CodecGzip:
+		w = gzip.NewWriter(buf)
+	case CodecFlate:
+		w, err = flate.NewWriter(buf, flate.BestCompression)
+	default:
+		return nil, fmt.Errorf("unknown codec (%d)", codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = i.writeBinary(w); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalCompressed replaces the ibf by the filter encoded in data by MarshalCompressed.
+func (i *ibf) UnmarshalCompressed(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("missing codec tag")
+	}
+	var r io.Reader
+	var err error
+	switch Codec(data[0]) {
+	case CodecNone:
+		return i.UnmarshalBinary(data[1:])
+	case CodecGzip:
+		if r, err = gzip.NewReader(bytes.NewReader(data[1:])); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorruptFilter, err)
+		}
+	case CodecFlate:
+		r = flate.NewReader(bytes.NewReader(data[1:]))
+	default:
+		return fmt.Errorf("unknown codec (%d)", data[0])
+	}
+	return i.readStream(r)
+}
+
+// maxPreallocatedBuckets bounds the buckets allocated up front by readStream, the rest is allocated as the data arrives
+const maxPreallocatedBuckets = 1 << 16
+
+// readStream replaces the ibf by the binary encoding read from a stream of untrusted size, e.g. a decompressing reader.
+// No more than the size implied by the header is read, so a small compressed input cannot inflate without bounds, and
+// the stream must end after the buckets.
+func (i *ibf) readStream(r io.Reader) error {
+	newIbf, numBuckets, order, err := readHeader(r)
+	if err != nil {
+		return err
+	}
+	limited := io.LimitReader(r, int64(numBuckets)*int64(newIbf.bucketBytes()))
+	buckets := make(sliceStore, 0, minInt(numBuckets, maxPreallocatedBuckets))
+	for idx := 0; idx < numBuckets; idx++ {
+		b, err := newIbf.readBucket(limited, order)
+		if err != nil {
+			return err
+		}
+		buckets = append(buckets, b)
+	}
+	if _, err = io.ReadFull(r, make([]byte, 1)); err != io.EOF {
+		if err == nil {
+			return fmt.Errorf("%w: trailing data after the Buckets", ErrCorruptFilter)
+		}
+		return fmt.Errorf("%w: %v", ErrCorruptFilter, err)
+	}
+	newIbf.Buckets = buckets
+	*i = *newIbf
+	return nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
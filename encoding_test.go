@@ -0,0 +1,249 @@
+package bloom
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestIbf_MarshalBinary(t *testing.T) {
+	filter := NewIbf(64)
+	filter.PreserveLength = true
+	filter.Add(generateData())
+	filter.Add(generateData()[:20])
+	filter.Delete(generateData())
+
+	data, err := filter.MarshalBinary()
+	assert.NoError(t, err)
+	decoded := &ibf{}
+	err = decoded.UnmarshalBinary(data)
+
+	assert.NoError(t, err)
+	assert.True(t, decoded.Equals(filter))
+	assert.Equal(t, filter.Lengths, decoded.Lengths)
+
+	t.Run("count width", func(t *testing.T) {
+		for _, width := range []int{8, 16, 32} {
+			filter := NewIbf(64)
+			filter.CountWidth = width
+			filter.Add(generateData())
+			filter.Delete(generateData())
+			data, err := filter.MarshalBinary()
+			assert.NoError(t, err)
+			decoded := &ibf{}
+
+			assert.NoError(t, decoded.UnmarshalBinary(data))
+			assert.True(t, decoded.Equals(filter), "count width %d", width)
+		}
+	})
+
+	t.Run("shard", func(t *testing.T) {
+		shard := filter.Split(2)[1]
+		data, err := shard.MarshalBinary()
+		assert.NoError(t, err)
+		decoded := &ibf{}
+
+		assert.NoError(t, decoded.UnmarshalBinary(data))
+		assert.Equal(t, shard.Shard, decoded.Shard)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		assert.ErrorIs(t, (&ibf{}).UnmarshalBinary(data[:len(data)-1]), ErrCorruptFilter)
+		assert.ErrorIs(t, (&ibf{}).UnmarshalBinary(data[:5]), ErrCorruptFilter)
+	})
+
+	t.Run("key length exceeds MaxKeyLength", func(t *testing.T) {
+		corrupt := append([]byte{}, data...)
+		// prefix (3), flags (1), count width (1), K (4) and seed (4) precede the key length
+		binary.LittleEndian.PutUint32(corrupt[13:], 1<<20)
+		assert.EqualError(t, (&ibf{}).UnmarshalBinary(corrupt), "corrupt filter: invalid header")
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		corrupt := append([]byte{}, data...)
+		corrupt[0] = binaryVersion + 1
+		assert.Error(t, (&ibf{}).UnmarshalBinary(corrupt))
+	})
+}
+
+func TestIbf_TransmitCost(t *testing.T) {
+	for _, numBuckets := range []int{16, 100, 1024} {
+		for _, numKeys := range []int{0, 10, 500} {
+			filter := NewIbf(numBuckets)
+			filter.PreserveLength = true
+			for n := 0; n < numKeys; n++ {
+				key := generateData()
+				filter.Add(key[:1+n%keyLength])
+			}
+
+			data, err := filter.MarshalBinary()
+
+			assert.NoError(t, err)
+			assert.Equal(t, len(data), filter.TransmitCost(), "%d Buckets, %d keys", numBuckets, numKeys)
+		}
+	}
+
+	t.Run("shard with CountWidth", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.CountWidth = 16
+		shards := filter.Split(2)
+
+		data, err := shards[1].MarshalBinary()
+
+		assert.NoError(t, err)
+		assert.Equal(t, len(data), shards[1].TransmitCost())
+	})
+}
+
+func TestIbf_SubtractFrom(t *testing.T) {
+	local, remote := NewIbf(64), NewIbf(64)
+	local.PreserveLength, remote.PreserveLength = true, true
+	for n := 0; n < 10; n++ {
+		key := generateData()
+		local.Add(key)
+		remote.Add(key)
+	}
+	local.Add(generateData())
+	remote.Add(generateData()[:20])
+	expected := local.clone()
+	assert.NoError(t, expected.Subtract(remote))
+
+	r, w := io.Pipe()
+	go func() {
+		data, _ := remote.MarshalBinary()
+		// write in small chunks to exercise incremental reads
+		for len(data) > 0 {
+			n := 7
+			if len(data) < n {
+				n = len(data)
+			}
+			w.Write(data[:n])
+			data = data[n:]
+		}
+		w.Close()
+	}()
+
+	assert.NoError(t, local.SubtractFrom(r))
+	assert.True(t, local.Equals(expected))
+	assert.Equal(t, expected.Lengths, local.Lengths)
+
+	t.Run("incompatible", func(t *testing.T) {
+		data, _ := NewIbf(32).MarshalBinary()
+		assert.EqualError(t, NewIbf(64).SubtractFrom(bytes.NewReader(data)), "subtraction failed: unequal number of Buckets, expected (64) got (32)")
+
+		data, _ = NewIbfWithSeed(64, Seed(1)).MarshalBinary()
+		assert.Error(t, NewIbf(64).SubtractFrom(bytes.NewReader(data)))
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		data, _ := remote.MarshalBinary()
+
+		assert.ErrorIs(t, NewIbf(64).SubtractFrom(bytes.NewReader(data[:len(data)-1])), ErrCorruptFilter)
+	})
+}
+
+func TestIbf_MarshalBinary_byteOrder(t *testing.T) {
+	filter := NewIbf(16)
+	filter.CountWidth = 16
+	filter.Add(generateData())
+	filter.Delete(generateData())
+
+	t.Run("little-endian", func(t *testing.T) {
+		data, err := filter.MarshalBinary()
+		assert.NoError(t, err)
+
+		assert.Equal(t, []byte{binaryVersion, 0x02, 0x01}, data[:3])
+		// CountWidth at offset 4, K as uint32 at offset 5
+		assert.Equal(t, []byte{4, 0, 0, 0}, data[5:9])
+	})
+
+	t.Run("big-endian", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		assert.NoError(t, filter.writeBinaryOrder(buf, binary.BigEndian))
+		data := buf.Bytes()
+		assert.Equal(t, []byte{binaryVersion, 0x01, 0x02}, data[:3])
+		assert.Equal(t, []byte{0, 0, 0, 4}, data[5:9])
+
+		decoded := &ibf{}
+		assert.NoError(t, decoded.UnmarshalBinary(data))
+		assert.True(t, decoded.Equals(filter), "big-endian encoding was misinterpreted")
+	})
+
+	t.Run("unknown tag", func(t *testing.T) {
+		data, err := filter.MarshalBinary()
+		assert.NoError(t, err)
+		data[1], data[2] = 0x02, 0x02
+
+		assert.ErrorIs(t, (&ibf{}).UnmarshalBinary(data), ErrCorruptFilter)
+	})
+}
+
+func TestIbf_MarshalCompressed(t *testing.T) {
+	ibfA, ibfB := NewIbf(1024), NewIbf(1024)
+	for n := 0; n < 200; n++ {
+		shared := generateData()
+		ibfA.Add(shared)
+		ibfB.Add(shared)
+	}
+	ibfA.Add(generateData())
+	ibfB.Add(generateData())
+	assert.NoError(t, ibfA.Subtract(ibfB))
+	raw, err := ibfA.MarshalBinary()
+	assert.NoError(t, err)
+
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecFlate} {
+		compressed, err := ibfA.MarshalCompressed(codec)
+		assert.NoError(t, err)
+		decoded := &ibf{}
+
+		assert.NoError(t, decoded.UnmarshalCompressed(compressed), "codec %d", codec)
+		assert.True(t, decoded.Equals(ibfA), "codec %d", codec)
+		if codec != CodecNone {
+			assert.Less(t, len(compressed), len(raw)/10, "codec %d", codec)
+		}
+	}
+
+	t.Run("inflated trailing data", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		buf.WriteByte(byte(CodecGzip))
+		w := gzip.NewWriter(buf)
+		assert.NoError(t, NewIbf(16).writeBinary(w))
+		zeros := make([]byte, 1<<20)
+		for n := 0; n < 16; n++ {
+			w.Write(zeros)
+		}
+		assert.NoError(t, w.Close())
+
+		err := (&ibf{}).UnmarshalCompressed(buf.Bytes())
+
+		assert.ErrorIs(t, err, ErrCorruptFilter)
+	})
+
+	t.Run("header exceeds data", func(t *testing.T) {
+		data, err := NewIbf(16).MarshalBinary()
+		assert.NoError(t, err)
+		// NumBuckets follows the prefix, Flags, CountWidth, K, Seed and KeyLength
+		binary.LittleEndian.PutUint32(data[3+2+12:], math.MaxUint32)
+		buf := &bytes.Buffer{}
+		buf.WriteByte(byte(CodecFlate))
+		w, _ := flate.NewWriter(buf, flate.BestCompression)
+		w.Write(data)
+		assert.NoError(t, w.Close())
+
+		err = (&ibf{}).UnmarshalCompressed(buf.Bytes())
+
+		assert.ErrorIs(t, err, ErrCorruptFilter)
+	})
+
+	t.Run("unknown codec", func(t *testing.T) {
+		_, err := ibfA.MarshalCompressed(Codec(42))
+		assert.Error(t, err)
+		assert.Error(t, (&ibf{}).UnmarshalCompressed([]byte{42}))
+		assert.Error(t, (&ibf{}).UnmarshalCompressed(nil))
+	})
+}
@@ -0,0 +1,62 @@
+package bloom
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// fileMagic starts every file written by SaveToFile
+var fileMagic = []byte("IBF\x00")
+
+// fileVersion is the version of the file layout, the binary format of the filter is versioned separately
+const fileVersion = 1
+
+// SaveToFile writes the filter to the file at path as fileMagic, the file version and the binary format of the filter.
+// The file is written to a temporary file in the same directory first and then renamed, so readers never see a
+// partially written filter.
+func (i *ibf) SaveToFile(path string) error {
+	buf := bytes.NewBuffer(append([]byte{}, fileMagic...))
+	buf.WriteByte(fileVersion)
+	if err := i.writeBinary(buf); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	// removing fails once the file has been renamed
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadFromFile reads a filter written by SaveToFile.
+func LoadFromFile(path string) (*ibf, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(fileMagic)+1 || !bytes.Equal(data[:len(fileMagic)], fileMagic) {
+		return nil, fmt.Errorf("%s is not a filter file", path)
+	}
+	if version := data[len(fileMagic)]; version != fileVersion {
+		return nil, fmt.Errorf("unsupported file version (%d) of %s", version, path)
+	}
+	newIbf := &ibf{}
+	if err = newIbf.UnmarshalBinary(data[len(fileMagic)+1:]); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return newIbf, nil
+}
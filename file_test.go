@@ -0,0 +1,70 @@
+package bloom
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIbf_SaveToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter.ibf")
+	filter := NewIbf(64)
+	filter.Add(generateData())
+
+	assert.NoError(t, filter.SaveToFile(path))
+	loaded, err := LoadFromFile(path)
+
+	assert.NoError(t, err)
+	assert.True(t, loaded.Equals(filter))
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	assert.Len(t, entries, 1, "temporary file is removed")
+
+	t.Run("overwrite", func(t *testing.T) {
+		filter.Add(generateData())
+
+		assert.NoError(t, filter.SaveToFile(path))
+		loaded, err := LoadFromFile(path)
+
+		assert.NoError(t, err)
+		assert.True(t, loaded.Equals(filter))
+	})
+}
+
+func TestLoadFromFile(t *testing.T) {
+	dir := t.TempDir()
+	data, _ := NewIbf(64).MarshalBinary()
+
+	t.Run("unknown magic", func(t *testing.T) {
+		path := filepath.Join(dir, "magic")
+		os.WriteFile(path, data, 0o600)
+
+		_, err := LoadFromFile(path)
+
+		assert.EqualError(t, err, path+" is not a filter file")
+	})
+
+	t.Run("old version", func(t *testing.T) {
+		path := filepath.Join(dir, "version")
+		os.WriteFile(path, append(append(append([]byte{}, fileMagic...), fileVersion-1), data...), 0o600)
+
+		_, err := LoadFromFile(path)
+
+		assert.EqualError(t, err, "unsupported file version (0) of "+path)
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		path := filepath.Join(dir, "corrupt")
+		os.WriteFile(path, append(append(append([]byte{}, fileMagic...), fileVersion), data[:10]...), 0o600)
+
+		_, err := LoadFromFile(path)
+
+		assert.ErrorIs(t, err, ErrCorruptFilter)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := LoadFromFile(filepath.Join(dir, "missing"))
+
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
@@ -0,0 +1,42 @@
+package bloom
+
+import "fmt"
+
+// FrozenIbf is an immutable snapshot of an ibf. Unlike a ReadOnlyIbf, which is a view on a filter that can still be
+// modified through the original, a FrozenIbf owns its buckets, so it is safe for concurrent use by multiple goroutines.
+// Use it to serve many reconciliations against the same set state without rebuilding the filter for each of them.
+type FrozenIbf struct {
+	filter *ibf
+}
+
+// Freeze returns an immutable snapshot of the filter. Later changes to the filter do not affect the snapshot.
+func (i *ibf) Freeze() *FrozenIbf {
+	return &FrozenIbf{filter: i.clone()}
+}
+
+// Clone returns a mutable copy of the snapshot.
+func (f *FrozenIbf) Clone() *ibf {
+	return f.filter.clone()
+}
+
+// Diff subtracts other from a copy of the snapshot and decodes the difference. The snapshot is left untouched, other
+// is only read and must not be modified during the call.
+func (f *FrozenIbf) Diff(other *ibf) (remaining [][]byte, missing [][]byte, err error) {
+	diff := f.filter.clone()
+	if err = diff.Subtract(other); err != nil {
+		return nil, nil, fmt.Errorf("diff failed: %w", err)
+	}
+	return diff.Decode()
+}
+
+func (f *FrozenIbf) IsEmpty() bool {
+	return f.filter.IsEmpty()
+}
+
+func (f *FrozenIbf) Stats() Stats {
+	return f.filter.Stats()
+}
+
+func (f *FrozenIbf) MarshalBinary() ([]byte, error) {
+	return f.filter.MarshalBinary()
+}
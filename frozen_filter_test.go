@@ -0,0 +1,57 @@
+package bloom
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestIbf_Freeze(t *testing.T) {
+	filter := NewIbf(256)
+	keysA, keysB := generateSets(50, 40)
+	for _, key := range keysA {
+		filter.Add(key)
+	}
+	frozen := filter.Freeze()
+	exp := filter.clone()
+	filter.Add(generateData())
+
+	t.Run("independent of the original", func(t *testing.T) {
+		assert.True(t, frozen.filter.Equals(exp))
+	})
+
+	t.Run("Clone", func(t *testing.T) {
+		c := frozen.Clone()
+		c.Add(generateData())
+
+		assert.True(t, frozen.filter.Equals(exp), "snapshot was modified")
+	})
+
+	t.Run("concurrent Diff", func(t *testing.T) {
+		onlyA, onlyB := symmetricDifference(keysA, keysB)
+		wg := sync.WaitGroup{}
+		for n := 0; n < 16; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				other := NewIbf(256)
+				for _, key := range keysB {
+					other.Add(key)
+				}
+				remaining, missing, err := frozen.Diff(other)
+				assert.NoError(t, err)
+				assert.ElementsMatch(t, onlyA, remaining)
+				assert.ElementsMatch(t, onlyB, missing)
+			}()
+		}
+		wg.Wait()
+
+		assert.True(t, frozen.filter.Equals(exp), "snapshot was modified")
+	})
+
+	t.Run("invalid subtrahend", func(t *testing.T) {
+		_, _, err := frozen.Diff(NewIbf(64))
+
+		assert.Error(t, err)
+	})
+}
@@ -1,6 +1,6 @@
 module github.com/gerardsn/bloom
 
-go 1.17
+go 1.18
 
 require (
 	github.com/spaolacci/murmur3 v1.1.0
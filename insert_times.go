@@ -0,0 +1,73 @@
+package bloom
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// AddAt inserts the key like Add, but records the insertion at time t instead of the current time if TrackInsertTimes
+// is set, e.g. to rebuild a filter from a log of timestamped keys.
+func (i *ibf) AddAt(key []byte, t time.Time) error {
+	return i.updatePrepared(i.Prepare(key), 1, t)
+}
+
+// recordInsertTime raises the insertion time of the buckets to t.
+func (i *ibf) recordInsertTime(indices []uint64, t time.Time) {
+	if i.insertTimes == nil {
+		i.insertTimes = make([]int64, i.Buckets.Len())
+	}
+	for _, h := range indices {
+		if t.UnixNano() > i.insertTimes[h] {
+			i.insertTimes[h] = t.UnixNano()
+		}
+	}
+}
+
+// insertTime returns the latest time the key can have been added at, which is the oldest insertion time of its
+// buckets. Keys added before TrackInsertTimes was set count as added at the unix epoch.
+func (i *ibf) insertTime(key []byte) time.Time {
+	if i.insertTimes == nil {
+		return time.Unix(0, 0)
+	}
+	var oldest int64
+	for n, h := range i.IndicesFor(key) {
+		if n == 0 || i.insertTimes[h] < oldest {
+			oldest = i.insertTimes[h]
+		}
+	}
+	return time.Unix(0, oldest)
+}
+
+// PruneOlderThan removes the keys added before t from a filter with TrackInsertTimes set. Buckets only record their
+// most recent insertion, so the filter is decoded to find the keys and rebuilt from the keys it keeps. This has two
+// limitations:
+//   - the filter must be decodable, i.e. sized for all its keys instead of for a difference;
+//   - a key is only pruned if one of its buckets saw no insertions since t, so old keys that share all their buckets
+//     with newer keys are kept.
+//
+// The rebuilt filter is backed by an in-memory store. The filter is not modified if pruning fails.
+func (i *ibf) PruneOlderThan(t time.Time) error {
+	if !i.TrackInsertTimes {
+		return errors.New("prune failed: insert times are not tracked")
+	}
+	if i.tags != nil {
+		return errors.New("prune failed: tagged filters cannot be rebuilt")
+	}
+	keys, err := i.Keys()
+	if err != nil {
+		return fmt.Errorf("prune failed: %w", err)
+	}
+	pruned := i.emptyCopy(i.Buckets.Len())
+	for _, key := range keys {
+		if at := i.insertTime(key); !at.Before(t) {
+			if err = pruned.AddAt(key, at); err != nil {
+				return fmt.Errorf("prune failed: %w", err)
+			}
+		}
+	}
+	// the pruned filter replaces i itself, so it keeps the hook that emptyCopy does not copy
+	pruned.DecodeFailureHook = i.DecodeFailureHook
+	*i = *pruned
+	return nil
+}
@@ -0,0 +1,84 @@
+package bloom
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestIbf_PruneOlderThan(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	filter := NewIbf(256)
+	filter.TrackInsertTimes = true
+	var old, recent [][]byte
+	for n := 0; n < 40; n++ {
+		key := generateData()
+		at := start.Add(time.Duration(n) * time.Minute)
+		assert.NoError(t, filter.AddAt(key, at))
+		if n < 20 {
+			old = append(old, key)
+		} else {
+			recent = append(recent, key)
+		}
+	}
+	now := generateData()
+	assert.NoError(t, filter.Add(now))
+
+	err := filter.PruneOlderThan(start.Add(20 * time.Minute))
+
+	assert.NoError(t, err)
+	keys, err := filter.Keys()
+	assert.NoError(t, err)
+	// old keys only survive if all their buckets were refreshed by newer keys
+	assert.Contains(t, keys, now)
+	for _, key := range recent {
+		assert.Contains(t, keys, key)
+	}
+	assert.Less(t, len(keys), len(old)/2+len(recent)+1, "most old keys are pruned")
+
+	t.Run("insertion times are kept", func(t *testing.T) {
+		assert.NoError(t, filter.PruneOlderThan(start.Add(30*time.Minute)))
+
+		keys, err := filter.Keys()
+		assert.NoError(t, err)
+		for _, key := range recent[10:] {
+			assert.Contains(t, keys, key)
+		}
+		assert.Less(t, len(keys), len(recent)/2+len(recent[10:])+1)
+	})
+
+	t.Run("DecodeFailureHook is kept", func(t *testing.T) {
+		filter := NewIbf(16)
+		filter.TrackInsertTimes = true
+		calls := 0
+		filter.DecodeFailureHook = func([]byte) { calls++ }
+		assert.NoError(t, filter.AddAt(generateData(), start))
+
+		assert.NoError(t, filter.PruneOlderThan(start.Add(time.Hour)))
+		for n := 0; n < 40; n++ {
+			filter.Add(generateData())
+		}
+		_, _, err := filter.Decode()
+
+		assert.ErrorIs(t, err, ErrDecodeFailed)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("times are not tracked", func(t *testing.T) {
+		assert.EqualError(t, NewIbf(64).PruneOlderThan(start), "prune failed: insert times are not tracked")
+	})
+
+	t.Run("undecodable filter is not modified", func(t *testing.T) {
+		filter := NewIbf(16)
+		filter.TrackInsertTimes = true
+		for n := 0; n < 40; n++ {
+			filter.AddAt(generateData(), start)
+		}
+		exp := filter.clone()
+
+		err := filter.PruneOlderThan(start.Add(time.Hour))
+
+		assert.ErrorIs(t, err, ErrDecodeFailed)
+		assert.True(t, filter.Equals(exp))
+	})
+}
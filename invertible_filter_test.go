@@ -2,7 +2,10 @@ package bloom
 
 import (
 	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
 	"testing"
+	"time"
 )
 
 // Benchmarks
@@ -16,6 +19,157 @@ func BenchmarkIbf_a(b *testing.B) {
 	statistics(nDecodes, b)
 }
 
+func BenchmarkIbf_Decode(b *testing.B) {
+	filter := NewIbf(256)
+	for n := 0; n < 100; n++ {
+		filter.Add(generateData())
+	}
+
+	b.Run("Decode", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			b.StopTimer()
+			c := filter.clone()
+			b.StartTimer()
+			c.Decode()
+		}
+	})
+
+	b.Run("SkipHashVerification", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			b.StopTimer()
+			c := filter.clone()
+			c.SkipHashVerification = true
+			b.StartTimer()
+			c.Decode()
+		}
+	})
+
+	b.Run("DecodeInto", func(b *testing.B) {
+		b.ReportAllocs()
+		var remaining, missing [][]byte
+		for n := 0; n < b.N; n++ {
+			b.StopTimer()
+			c := filter.clone()
+			remaining, missing = remaining[:0], missing[:0]
+			b.StartTimer()
+			c.DecodeInto(&remaining, &missing)
+		}
+	})
+}
+
+func BenchmarkBucket_isEmpty(b *testing.B) {
+	bucket := newBucket(keyLength)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		bucket.isEmpty()
+	}
+}
+
+func BenchmarkIbf_PeelStrategy(b *testing.B) {
+	filter := NewIbf(1024)
+	for n := 0; n < 600; n++ {
+		filter.Add(generateData())
+	}
+
+	for name, strategy := range map[string]PeelStrategy{"SliceOrder": PeelSliceOrder, "FIFO": PeelFIFO, "LIFO": PeelLIFO} {
+		b.Run(name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				c := filter.clone()
+				c.PeelStrategy = strategy
+				b.StartTimer()
+				c.Decode()
+			}
+		})
+	}
+}
+
+func BenchmarkIbf_IndexFunc(b *testing.B) {
+	for name, indexFunc := range map[string]IndexFunc{"Xorshift": IndexXorshift, "DoubleHashing": IndexDoubleHashing} {
+		b.Run(name, func(b *testing.B) {
+			filter := NewIbf(1024)
+			filter.IndexFunc = indexFunc
+			key := generateData()
+			hash := filter.hashKey(key)
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				filter.bucketIndices(hash)
+			}
+		})
+	}
+}
+
+func BenchmarkIbf_HashFunc(b *testing.B) {
+	key := generateData()
+	for name, hashFunc := range map[string]HashFunc{"Murmur3": HashMurmur3, "FNV1a": HashFNV1a} {
+		b.Run(name, func(b *testing.B) {
+			filter := NewIbf(1024)
+			filter.HashFunc = hashFunc
+			for n := 0; n < b.N; n++ {
+				filter.hashKey(key)
+			}
+		})
+	}
+}
+
+func BenchmarkIbf_AddPrepared(b *testing.B) {
+	filter := NewIbf(256)
+	keys := make([][]byte, 100)
+	prepared := make([]PreparedKey, len(keys))
+	for n := range keys {
+		keys[n] = generateData()
+		prepared[n] = filter.Prepare(keys[n])
+	}
+
+	b.Run("Add", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, key := range keys {
+				filter.Add(key)
+			}
+		}
+	})
+
+	b.Run("AddPrepared", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, key := range prepared {
+				filter.AddPrepared(key)
+			}
+		}
+	})
+}
+
+func BenchmarkIbf_DiffReusable(b *testing.B) {
+	local, remote := NewIbf(256), NewIbf(256)
+	for n := 0; n < 1000; n++ {
+		key := generateData()
+		local.Add(key)
+		remote.Add(key)
+	}
+	for n := 0; n < 20; n++ {
+		local.Add(generateData())
+		remote.Add(generateData())
+	}
+
+	b.Run("clone", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			diff := local.clone()
+			diff.Subtract(remote)
+			diff.Decode()
+		}
+	})
+
+	b.Run("DiffReusable", func(b *testing.B) {
+		b.ReportAllocs()
+		scratch := NewIbf(256)
+		for n := 0; n < b.N; n++ {
+			local.DiffReusable(remote, scratch)
+		}
+	})
+}
+
 // doubling the amount of buckets, more than doubles the set difference that can be solved
 func runTest() int {
 	numBuckets := 1024
@@ -32,45 +186,1585 @@ func runTest() int {
 			ibfB.Add(a)
 		}
 	}
-	ibfA.Subtract(ibfB)
-	if _, _, err := ibfA.Decode(); err != nil {
-		return 0
+	ibfA.Subtract(ibfB)
+	if _, _, err := ibfA.Decode(); err != nil {
+		return 0
+	}
+
+	return 1
+}
+
+// Test IBLT
+func TestIbf_Add(t *testing.T) {
+	t.Run("key longer than KeyLength", func(t *testing.T) {
+		filter := NewIbf(64)
+		key := append(generateData(), generateData()[:8]...)
+
+		assert.ErrorIs(t, filter.Add(key), ErrCorruptFilter)
+		assert.ErrorIs(t, filter.AddPrepared(filter.Prepare(key)), ErrCorruptFilter)
+		assert.True(t, filter.IsEmpty(), "filter is not modified")
+		assert.NoError(t, filter.Add(key[:keyLength]))
+	})
+}
+
+func TestIbf_validate(t *testing.T) {
+	for name, filter := range map[string]*ibf{
+		"zero value":   {},
+		"zero buckets": NewIbf(0),
+		"K too large":  {Buckets: make(sliceStore, 2), K: 3},
+	} {
+		assert.ErrorIs(t, filter.Add(generateData()), ErrCorruptFilter, name)
+		assert.ErrorIs(t, filter.Delete(generateData()), ErrCorruptFilter, name)
+	}
+
+	t.Run("json", func(t *testing.T) {
+		_, err := UnmarshalJson([]byte(`{"Buckets":[],"K":4}`))
+		assert.ErrorIs(t, err, ErrCorruptFilter)
+
+		_, err = UnmarshalJson([]byte(`{"Buckets":[{"count":0}],"K":1,"key_length":1000000}`))
+		assert.ErrorIs(t, err, ErrCorruptFilter, "KeyLength exceeds MaxKeyLength")
+
+		_, err = UnmarshalJson([]byte(`{"Buckets":[{"count":0}],"K":1,"key_length":0}`))
+		assert.ErrorIs(t, err, ErrCorruptFilter, "KeyLength zero")
+
+		data := `{"Buckets":[{"count":1,"key_sum":"AQ==","hash_sum":0},{"count":0,"key_sum":"AAA=","hash_sum":0}],"K":1,"key_length":2}`
+		_, err = UnmarshalJson([]byte(data))
+		assert.ErrorIs(t, err, ErrCorruptFilter, "keySum shorter than KeyLength")
+	})
+}
+
+func TestNewIbfWithKeyLength(t *testing.T) {
+	filter, err := NewIbfWithKeyLength(64, 64)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 64, filter.KeyLength)
+	assert.Equal(t, 64, filter.Buckets.Len())
+	assert.NoError(t, filter.Add(make([]byte, 64)))
+
+	for _, invalid := range []int{0, MaxKeyLength + 1} {
+		_, err = NewIbfWithKeyLength(64, invalid)
+		assert.ErrorIs(t, err, ErrCorruptFilter)
+	}
+}
+
+func TestNewIbfForMemory(t *testing.T) {
+	for _, maxBytes := range []int{1 << 10, 1<<20 + 7, 10 << 20} {
+		filter, err := NewIbfForMemory(maxBytes, 16)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 16, filter.KeyLength)
+		assert.LessOrEqual(t, filter.ApproximateMemoryUsage(), maxBytes)
+		assert.Greater(t, filter.ApproximateMemoryUsage()+filter.bucketBytes(), maxBytes, "largest number of buckets")
+	}
+
+	t.Run("tags", func(t *testing.T) {
+		filter := NewIbf(64)
+		usage := filter.ApproximateMemoryUsage()
+
+		assert.NoError(t, filter.AddTagged(generateData(), 1))
+		assert.Equal(t, usage+64, filter.ApproximateMemoryUsage())
+	})
+
+	t.Run("clamped to MinBuckets", func(t *testing.T) {
+		filter, err := NewIbfForMemory(100, keyLength)
+
+		assert.NoError(t, err)
+		assert.Equal(t, MinBuckets, filter.Buckets.Len())
+	})
+
+	t.Run("invalid key length", func(t *testing.T) {
+		_, err := NewIbfForMemory(1<<20, MaxKeyLength+1)
+
+		assert.ErrorIs(t, err, ErrCorruptFilter)
+	})
+}
+
+func TestIbf_AddUnique(t *testing.T) {
+	filter := NewIbf(1024)
+	keys := make([][]byte, 20)
+	for idx := range keys {
+		keys[idx] = generateData()
+		added, err := filter.AddUnique(keys[idx])
+		assert.NoError(t, err)
+		assert.True(t, added, "failed to add new key")
+	}
+	for _, key := range keys {
+		added, err := filter.AddUnique(key)
+		assert.NoError(t, err)
+		assert.False(t, added, "adding key for the second time should be skipped")
+	}
+
+	remaining, missing, err := filter.Decode()
+
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, keys, remaining)
+	assert.Empty(t, missing)
+
+	t.Run("invalid filter", func(t *testing.T) {
+		added, err := NewIbf(0).AddUnique(generateData())
+
+		assert.ErrorIs(t, err, ErrCorruptFilter)
+		assert.False(t, added)
+	})
+}
+
+func TestIbf_PreserveLength(t *testing.T) {
+	short, long := generateData()[:20], generateData()
+
+	t.Run("length preserving", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.PreserveLength = true
+		filter.Add(short)
+		filter.Add(long)
+
+		remaining, _, err := filter.Decode()
+
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, [][]byte{short, long}, remaining)
+	})
+
+	t.Run("after subtraction", func(t *testing.T) {
+		ibfA, ibfB := NewIbf(64), NewIbf(64)
+		ibfA.PreserveLength = true
+		ibfB.PreserveLength = true
+		ibfA.Add(long)
+		ibfB.Add(short)
+		assert.NoError(t, ibfA.Subtract(ibfB))
+
+		remaining, missing, err := ibfA.Decode()
+
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{long}, remaining)
+		assert.Equal(t, [][]byte{short}, missing)
+	})
+
+	t.Run("keys differing in trailing zero bytes", func(t *testing.T) {
+		withZeros := func(key []byte, n int) []byte {
+			return append(append([]byte{}, key...), make([]byte, n)...)
+		}
+		// the last pair pads to a key of KeyLength bytes
+		pairs := [][2][]byte{{[]byte("ab"), []byte("ab\x00")}, {short, withZeros(short, 2)}, {long[:31], withZeros(long[:31], 1)}}
+		for _, keys := range pairs {
+			ibfA, ibfB := NewIbf(64), NewIbf(64)
+			ibfA.PreserveLength = true
+			ibfB.PreserveLength = true
+			ibfA.Add(keys[0])
+			ibfB.Add(keys[1])
+			assert.NoError(t, ibfA.Subtract(ibfB))
+
+			remaining, missing, err := ibfA.Decode()
+
+			assert.NoError(t, err)
+			assert.Equal(t, [][]byte{keys[0]}, remaining)
+			assert.Equal(t, [][]byte{keys[1]}, missing)
+		}
+	})
+
+	t.Run("default pads short keys", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.Add(short)
+
+		remaining, _, err := filter.Decode()
+
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{append(append([]byte{}, short...), make([]byte, 12)...)}, remaining)
+	})
+}
+
+func TestIbf_AddIfInRange(t *testing.T) {
+	full, low, high := NewIbf(256), NewIbf(256), NewIbf(256)
+	var keys, lowKeys, highKeys [][]byte
+	for n := 0; n < 100; n++ {
+		key := generateData()
+		keys = append(keys, key)
+		full.Add(key)
+
+		inLow, err := low.AddIfInRange(key, 0, 1<<63)
+		assert.NoError(t, err)
+		inHigh, err := high.AddIfInRange(key, 1<<63, 0)
+		assert.NoError(t, err)
+
+		assert.NotEqual(t, inLow, inHigh, "ranges partition the keys")
+		if inLow {
+			lowKeys = append(lowKeys, key)
+			assert.Less(t, full.hashKey(key), uint64(1<<63))
+		} else {
+			highKeys = append(highKeys, key)
+		}
+	}
+
+	decodedLow, err := low.Keys()
+	assert.NoError(t, err)
+	decodedHigh, err := high.Keys()
+	assert.NoError(t, err)
+	assert.NoError(t, compareKeys(lowKeys, decodedLow))
+	assert.NoError(t, compareKeys(highKeys, decodedHigh))
+	assert.NoError(t, compareKeys(keys, append(decodedLow, decodedHigh...)))
+}
+
+func TestIbf_AddTagged(t *testing.T) {
+	sources := map[byte][][]byte{1: {generateData(), generateData()}, 2: {generateData(), generateData(), generateData()}}
+	merged := NewIbf(64)
+	for tag, keys := range sources {
+		for _, key := range keys {
+			assert.NoError(t, merged.AddTagged(key, tag))
+		}
+	}
+
+	remaining, missing, err := merged.DecodeTagged()
+
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+	assert.Len(t, remaining, 5)
+	for _, key := range remaining {
+		assert.Contains(t, sources[key.Tag], key.Key)
+	}
+
+	t.Run("after subtraction", func(t *testing.T) {
+		a, b := NewIbf(64), NewIbf(64)
+		for _, key := range sources[1] {
+			a.AddTagged(key, 1)
+		}
+		for _, key := range sources[2] {
+			b.AddTagged(key, 2)
+		}
+		a.Subtract(b)
+
+		remaining, missing, err := a.DecodeTagged()
+
+		assert.NoError(t, err)
+		assert.Len(t, remaining, 2)
+		assert.Len(t, missing, 3)
+		for _, key := range remaining {
+			assert.Equal(t, byte(1), key.Tag)
+		}
+		for _, key := range missing {
+			assert.Equal(t, byte(2), key.Tag)
+		}
+	})
+
+	t.Run("untagged", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.Add(generateData())
+
+		remaining, _, err := filter.DecodeTagged()
+
+		assert.NoError(t, err)
+		assert.Equal(t, byte(0), remaining[0].Tag)
+	})
+}
+
+func TestIbf_MayContain(t *testing.T) {
+	filter := NewIbf(1024)
+	key := generateData()
+	assert.False(t, filter.MayContain(key), "empty filter cannot contain key")
+	filter.Add(key)
+	assert.True(t, filter.MayContain(key), "added key must be reported")
+	assert.False(t, NewIbf(0).MayContain(key), "invalid filter cannot contain key")
+}
+
+func TestIbf_CountWidth(t *testing.T) {
+	t.Run("normal usage stays within bounds", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.CountWidth = 16
+		for n := 0; n < 1000; n++ {
+			assert.NoError(t, filter.Add(generateData()))
+		}
+	})
+
+	t.Run("add overflow", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.CountWidth = 16
+		key := generateData()
+		h := filter.bucketIndices(filter.hashKey(key))[0]
+		filter.Buckets.Get(int(h)).count = math.MaxInt16
+		exp := filter.clone()
+
+		err := filter.Add(key)
+
+		assert.ErrorIs(t, err, ErrCorruptFilter)
+		assert.True(t, filter.bucketsEqual(exp), "filter was modified")
+	})
+
+	t.Run("delete overflow", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.CountWidth = 32
+		key := generateData()
+		h := filter.bucketIndices(filter.hashKey(key))[0]
+		filter.Buckets.Get(int(h)).count = math.MinInt32
+
+		assert.ErrorIs(t, filter.Delete(key), ErrCorruptFilter)
+	})
+
+	t.Run("subtract overflow", func(t *testing.T) {
+		ibfA, ibfB := NewIbf(64), NewIbf(64)
+		ibfA.CountWidth, ibfB.CountWidth = 16, 16
+		ibfA.Buckets.Get(0).count = math.MinInt16
+		ibfB.Buckets.Get(0).count = 1
+
+		assert.ErrorIs(t, ibfA.Subtract(ibfB), ErrCorruptFilter)
+	})
+
+	t.Run("full int range", func(t *testing.T) {
+		filter := NewIbf(64)
+		key := generateData()
+		h := filter.bucketIndices(filter.hashKey(key))[0]
+		filter.Buckets.Get(int(h)).count = math.MaxInt
+
+		assert.ErrorIs(t, filter.Add(key), ErrCorruptFilter)
+	})
+}
+
+func TestIbf_OverflowPolicy(t *testing.T) {
+	// atBoundary returns a filter with a 16-bit count at its maximum in the first bucket of key
+	atBoundary := func(policy OverflowPolicy, key []byte) (*ibf, int) {
+		filter := NewIbf(64)
+		filter.CountWidth = 16
+		filter.OverflowPolicy = policy
+		h := int(filter.IndicesFor(key)[0])
+		filter.Buckets.Get(h).count = math.MaxInt16
+		return filter, h
+	}
+
+	t.Run("error", func(t *testing.T) {
+		key := generateData()
+		filter, _ := atBoundary(OverflowError, key)
+		exp := filter.clone()
+
+		err := filter.Add(key)
+
+		assert.ErrorIs(t, err, ErrCountOverflow)
+		assert.ErrorIs(t, err, ErrCorruptFilter)
+		assert.True(t, filter.bucketsEqual(exp), "filter was modified")
+	})
+
+	t.Run("saturate", func(t *testing.T) {
+		key := generateData()
+		filter, h := atBoundary(OverflowSaturate, key)
+
+		assert.NoError(t, filter.Add(key))
+		assert.Equal(t, math.MaxInt16, filter.Buckets.Get(h).count)
+		assert.NoError(t, filter.Add(key))
+		assert.Equal(t, math.MaxInt16, filter.Buckets.Get(h).count)
+		assert.NoError(t, filter.Delete(key))
+		assert.Equal(t, math.MaxInt16-1, filter.Buckets.Get(h).count)
+	})
+
+	t.Run("saturate negative", func(t *testing.T) {
+		key := generateData()
+		filter, h := atBoundary(OverflowSaturate, key)
+		filter.Buckets.Get(h).count = math.MinInt16
+
+		assert.NoError(t, filter.Delete(key))
+		assert.Equal(t, math.MinInt16, filter.Buckets.Get(h).count)
+	})
+
+	t.Run("wrap", func(t *testing.T) {
+		key := generateData()
+		filter, h := atBoundary(OverflowWrap, key)
+
+		assert.NoError(t, filter.Add(key))
+		assert.Equal(t, math.MinInt16, filter.Buckets.Get(h).count)
+		assert.NoError(t, filter.Delete(key))
+		assert.Equal(t, math.MaxInt16, filter.Buckets.Get(h).count)
+	})
+
+	t.Run("wrapped counts decode", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.CountWidth = 2
+		filter.OverflowPolicy = OverflowWrap
+		key := generateData()
+		for n := 0; n < 4; n++ {
+			assert.NoError(t, filter.Add(key))
+		}
+		other := generateData()
+		assert.NoError(t, filter.Add(other))
+
+		remaining, _, err := filter.Decode()
+
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{other}, remaining)
+	})
+
+	t.Run("undersized filters with inexact counts", func(t *testing.T) {
+		for _, policy := range []OverflowPolicy{OverflowSaturate, OverflowWrap} {
+			r := rand.New(rand.NewSource(int64(policy)))
+			filter := NewIbf(64)
+			filter.CountWidth = 4
+			filter.OverflowPolicy = policy
+			for n := 0; n < 201; n++ {
+				key := make([]byte, keyLength)
+				r.Read(key)
+				assert.NoError(t, filter.Add(key))
+			}
+
+			_, _, err := filter.Decode()
+
+			assert.ErrorIs(t, err, ErrDecodeUndersized, "policy %d", policy)
+		}
+	})
+
+	t.Run("subtract fails regardless of policy", func(t *testing.T) {
+		ibfA, ibfB := NewIbf(64), NewIbf(64)
+		ibfA.CountWidth, ibfB.CountWidth = 16, 16
+		ibfA.OverflowPolicy = OverflowWrap
+		ibfA.Buckets.Get(0).count = math.MinInt16
+		ibfB.Buckets.Get(0).count = 1
+
+		assert.ErrorIs(t, ibfA.Subtract(ibfB), ErrCountOverflow)
+	})
+}
+
+func TestIbf_IndexFunc(t *testing.T) {
+	t.Run("test vectors", func(t *testing.T) {
+		filter := NewIbf(64)
+		assert.Equal(t, []uint64{52, 55, 22, 3}, filter.bucketIndices(0x0123456789abcdef))
+
+		filter.IndexFunc = IndexDoubleHashing
+		assert.Equal(t, []uint64{47, 22, 61, 36}, filter.bucketIndices(0x0123456789abcdef))
+		// h2 = 64 maps every index to h1, taken indices move to the next free bucket
+		assert.Equal(t, []uint64{5, 6, 7, 8}, filter.bucketIndices(0x0000004000000005))
+	})
+
+	t.Run("decode rates", func(t *testing.T) {
+		// decodeRate decodes the same keys for both index functions
+		decodeRate := func(indexFunc IndexFunc) float64 {
+			r := rand.New(rand.NewSource(1))
+			successes := 0
+			for trial := 0; trial < 50; trial++ {
+				filter := NewIbf(256)
+				filter.IndexFunc = indexFunc
+				for n := 0; n < 128; n++ {
+					key := make([]byte, keyLength)
+					r.Read(key)
+					filter.Add(key)
+				}
+				if _, _, err := filter.Decode(); err == nil {
+					successes++
+				}
+			}
+			return float64(successes) / 50
+		}
+
+		xorshift, doubleHashing := decodeRate(IndexXorshift), decodeRate(IndexDoubleHashing)
+
+		assert.Equal(t, 1.0, xorshift)
+		// keys with equal h1 and h2 modulo the number of buckets share all their buckets and cannot be peeled
+		assert.Less(t, doubleHashing, xorshift)
+		assert.Greater(t, doubleHashing, 0.5)
+	})
+
+	t.Run("filters with different IndexFunc cannot be subtracted", func(t *testing.T) {
+		ibfA, ibfB := NewIbf(64), NewIbf(64)
+		ibfB.IndexFunc = IndexDoubleHashing
+
+		assert.EqualError(t, ibfA.Subtract(ibfB), "subtraction failed: indexFuncs do not match, expected (0) got (1)")
+	})
+
+	t.Run("prepared keys", func(t *testing.T) {
+		filter := NewIbf(64)
+		key := filter.Prepare(generateData())
+		filter.IndexFunc = IndexDoubleHashing
+
+		assert.Error(t, filter.AddPrepared(key))
+	})
+
+	t.Run("binary encoding", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.IndexFunc = IndexDoubleHashing
+		filter.Add(generateData())
+		data, err := filter.MarshalBinary()
+		assert.NoError(t, err)
+
+		decoded := &ibf{}
+		assert.NoError(t, decoded.UnmarshalBinary(data))
+		assert.Equal(t, IndexDoubleHashing, decoded.IndexFunc)
+		assert.True(t, filter.Equals(decoded))
+	})
+
+	t.Run("unknown IndexFunc", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.IndexFunc = 9
+
+		assert.ErrorIs(t, filter.Add(generateData()), ErrCorruptFilter)
+	})
+}
+
+func TestIbf_HashFunc(t *testing.T) {
+	t.Run("FNV-1a", func(t *testing.T) {
+		// FNV-1a of "a" from the unseeded offset basis
+		assert.Equal(t, fmix64(0xaf63dc4c8601ec8c), fnv1a64([]byte("a"), 0))
+		assert.NotEqual(t, fnv1a64([]byte("a"), 0), fnv1a64([]byte("a"), 1))
+	})
+
+	t.Run("decode", func(t *testing.T) {
+		ibfA, ibfB := NewIbf(256), NewIbf(256)
+		ibfA.HashFunc, ibfB.HashFunc = HashFNV1a, HashFNV1a
+		keysA, keysB := generateSets(100, 50)
+		for n := range keysA {
+			ibfA.Add(keysA[n])
+			ibfB.Add(keysB[n])
+		}
+		assert.NoError(t, ibfA.Subtract(ibfB))
+
+		remaining, missing, err := ibfA.Decode()
+
+		assert.NoError(t, err)
+		onlyA, onlyB := symmetricDifference(keysA, keysB)
+		assert.ElementsMatch(t, onlyA, remaining)
+		assert.ElementsMatch(t, onlyB, missing)
+	})
+
+	t.Run("filters with different HashFunc cannot be subtracted", func(t *testing.T) {
+		ibfA, ibfB := NewIbf(64), NewIbf(64)
+		ibfB.HashFunc = HashFNV1a
+
+		assert.EqualError(t, ibfA.Subtract(ibfB), "subtraction failed: hashFuncs do not match, expected (0) got (1)")
+	})
+
+	t.Run("binary encoding", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.HashFunc = HashFNV1a
+		filter.Add(generateData())
+		data, err := filter.MarshalBinary()
+		assert.NoError(t, err)
+
+		decoded := &ibf{}
+		assert.NoError(t, decoded.UnmarshalBinary(data))
+		assert.True(t, filter.Equals(decoded))
+	})
+
+	t.Run("unknown HashFunc", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.HashFunc = 9
+
+		assert.ErrorIs(t, filter.Add(generateData()), ErrCorruptFilter)
+	})
+}
+
+func TestIbf_IndicesFor(t *testing.T) {
+	filter := NewIbf(64)
+	key := generateData()
+
+	filter.Add(key)
+
+	var touched []uint64
+	for idx := 0; idx < filter.Buckets.Len(); idx++ {
+		if !filter.Buckets.Get(idx).isEmpty() {
+			touched = append(touched, uint64(idx))
+		}
+	}
+	indices := filter.IndicesFor(key)
+	assert.Len(t, indices, filter.K)
+	assert.ElementsMatch(t, touched, indices)
+}
+
+func TestIbf_Delete(t *testing.T) {
+
+}
+
+func TestIbf_DeleteTracked(t *testing.T) {
+	filter := NewIbf(64)
+	key := generateData()
+	filter.Add(key)
+
+	wentNegative, err := filter.DeleteTracked(key)
+	assert.NoError(t, err)
+	assert.False(t, wentNegative)
+
+	wentNegative, err = filter.DeleteTracked(generateData())
+	assert.NoError(t, err)
+	assert.True(t, wentNegative, "never added")
+}
+
+func TestIbf_Prepare(t *testing.T) {
+	filter, prepared := NewIbf(64), NewIbf(64)
+	filter.PreserveLength, prepared.PreserveLength = true, true
+	a, b, short := generateData(), generateData(), generateData()[:20]
+	keyA, keyB, keyShort := filter.Prepare(a), filter.Prepare(b), filter.Prepare(short)
+
+	filter.Add(a)
+	filter.Delete(b)
+	filter.Add(short)
+	assert.NoError(t, prepared.AddPrepared(keyA))
+	assert.NoError(t, prepared.DeletePrepared(keyB))
+	assert.NoError(t, prepared.AddPrepared(keyShort))
+
+	assert.True(t, prepared.Equals(filter))
+	assert.Equal(t, filter.Lengths, prepared.Lengths)
+
+	t.Run("different parameters", func(t *testing.T) {
+		assert.Error(t, NewIbf(32).AddPrepared(keyA))
+		assert.Error(t, NewIbfWithSeed(64, Seed(1)).AddPrepared(keyA))
+		short, err := NewIbfWithKeyLength(64, 8)
+		assert.NoError(t, err)
+		assert.Error(t, NewIbf(64).AddPrepared(short.Prepare(generateData()[:8])))
+		salted := NewIbf(64)
+		salted.Salt = []byte("salt")
+		assert.Error(t, NewIbf(64).AddPrepared(salted.Prepare(generateData())))
+	})
+}
+
+func TestIbf_ConvertK(t *testing.T) {
+	numBuckets := 128
+	ibfA, ibfB := NewIbf(numBuckets), NewIbf(numBuckets)
+	ibfB.K = 3
+	a, b := generateData(), generateData()
+	for n := 0; n < 20; n++ {
+		shared := generateData()
+		ibfA.Add(shared)
+		ibfB.Add(shared)
+	}
+	ibfA.Add(a)
+	ibfB.Add(b)
+
+	converted, err := ibfA.ConvertK(3)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, converted.K)
+	assert.NoError(t, converted.Subtract(ibfB))
+	remaining, missing, err := converted.Decode()
+
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{a}, remaining)
+	assert.Equal(t, [][]byte{b}, missing)
+
+	t.Run("invalid K", func(t *testing.T) {
+		_, err := ibfA.ConvertK(0)
+		assert.Error(t, err)
+		_, err = ibfA.ConvertK(numBuckets + 1)
+		assert.Error(t, err)
+	})
+
+	t.Run("undecodable", func(t *testing.T) {
+		filter := NewIbf(8)
+		for n := 0; n < 32; n++ {
+			filter.Add(generateData())
+		}
+		_, err := filter.ConvertK(3)
+		assert.Error(t, err)
+	})
+}
+
+func TestIbf_Split(t *testing.T) {
+	numBuckets := 64
+	filter := NewIbf(numBuckets)
+	for n := 0; n < 20; n++ {
+		filter.Add(generateData())
+	}
+
+	for _, n := range []int{1, 2, 3, 7, numBuckets} {
+		shards := filter.Split(n)
+		assert.Len(t, shards, n)
+
+		joined, err := Join(shards)
+
+		assert.NoError(t, err, "%d shards", n)
+		assert.Nil(t, joined.Shard)
+		assert.True(t, joined.bucketsEqual(filter), "%d shards did not reproduce the filter", n)
+	}
+
+	t.Run("invalid n", func(t *testing.T) {
+		assert.Nil(t, filter.Split(0))
+		assert.Nil(t, filter.Split(numBuckets+1))
+	})
+
+	t.Run("any order", func(t *testing.T) {
+		shards := filter.Split(3)
+		joined, err := Join([]*ibf{shards[2], shards[0], shards[1]})
+
+		assert.NoError(t, err)
+		assert.True(t, joined.bucketsEqual(filter))
+	})
+
+	t.Run("missing shard", func(t *testing.T) {
+		shards := filter.Split(3)
+		_, err := Join(shards[:2])
+		assert.Error(t, err)
+		_, err = Join([]*ibf{shards[0], shards[2]})
+		assert.Error(t, err)
+	})
+
+	t.Run("not a shard", func(t *testing.T) {
+		_, err := Join([]*ibf{filter})
+		assert.Error(t, err)
+	})
+}
+
+func TestIbf_Reseed(t *testing.T) {
+	filter := NewIbf(64)
+	keys := [][]byte{generateData(), generateData(), generateData()}
+	for _, key := range keys {
+		filter.Add(key)
+	}
+
+	reseeded, err := filter.Reseed(42)
+	assert.NoError(t, err)
+	remaining, missing, err := reseeded.Decode()
+
+	assert.Equal(t, Seed(42), reseeded.Seed)
+	assert.Equal(t, defaultSeed, filter.Seed, "original filter was modified")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, keys, remaining)
+	assert.Empty(t, missing)
+}
+
+func TestIbf_Remap(t *testing.T) {
+	filter := NewIbf(64)
+	local, remote := generateData(), generateData()
+	filter.Add(local)
+	filter.Delete(remote)
+
+	remapped, err := filter.Remap(7, 256)
+	assert.NoError(t, err)
+	remaining, missing, err := remapped.Decode()
+
+	assert.NoError(t, err)
+	assert.Equal(t, Seed(7), remapped.Seed)
+	assert.Equal(t, 256, remapped.Buckets.Len())
+	assert.Equal(t, [][]byte{local}, remaining)
+	assert.Equal(t, [][]byte{remote}, missing)
+
+	t.Run("too few buckets", func(t *testing.T) {
+		_, err := filter.Remap(7, filter.K-1)
+		assert.Error(t, err)
+	})
+
+	t.Run("undecodable", func(t *testing.T) {
+		filter := NewIbf(8)
+		for n := 0; n < 32; n++ {
+			filter.Add(generateData())
+		}
+		_, err := filter.Remap(7, 1024)
+		assert.Error(t, err)
+	})
+}
+
+func TestIbf_Compact(t *testing.T) {
+	filter := NewIbf(4096)
+	var keys [][]byte
+	for n := 0; n < 50; n++ {
+		key := generateData()
+		keys = append(keys, key)
+		filter.Add(key)
+	}
+
+	compacted, err := filter.Compact()
+
+	assert.NoError(t, err)
+	assert.Less(t, compacted.Buckets.Len(), 4096)
+	assert.GreaterOrEqual(t, compacted.Buckets.Len(), RecommendedBuckets(50))
+	assert.Equal(t, 4096, filter.Buckets.Len(), "filter is not modified")
+	remaining, _, err := compacted.Decode()
+	assert.NoError(t, err)
+	assert.NoError(t, compareKeys(keys, remaining))
+
+	t.Run("already compact", func(t *testing.T) {
+		filter := NewIbf(MinBuckets)
+		filter.Add(generateData())
+
+		compacted, err := filter.Compact()
+
+		assert.NoError(t, err)
+		assert.True(t, compacted.Equals(filter))
+	})
+
+	t.Run("undecodable", func(t *testing.T) {
+		filter := NewIbf(16)
+		for n := 0; n < 32; n++ {
+			filter.Add(generateData())
+		}
+
+		_, err := filter.Compact()
+
+		assert.Error(t, err)
+	})
+}
+
+func TestIbf_Keys(t *testing.T) {
+	filter := NewIbf(256)
+	var keys [][]byte
+	for n := 0; n < 100; n++ {
+		key := generateData()
+		keys = append(keys, key)
+		filter.Add(key)
 	}
 
-	return 1
+	actual, err := filter.Keys()
+
+	assert.NoError(t, err)
+	assert.NoError(t, compareKeys(keys, actual))
+	assert.False(t, filter.IsEmpty(), "filter is not modified")
+
+	t.Run("negative count", func(t *testing.T) {
+		filter.Delete(generateData())
+
+		_, err := filter.Keys()
+
+		assert.EqualError(t, err, "filter holds (1) keys with a negative count")
+	})
 }
 
-// Test IBLT
-func TestIbf_Add(t *testing.T) {
+func TestIbf_IsZeroAfter(t *testing.T) {
+	keys := [][]byte{generateData(), generateData(), generateData()}
+
+	t.Run("empty filter", func(t *testing.T) {
+		filter := NewIbf(64)
+		assert.True(t, filter.IsZeroAfter(keys))
+		assert.True(t, filter.bucketsEqual(NewIbf(64)), "filter was modified")
+	})
 
+	t.Run("non-empty filter", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.Add(generateData())
+		exp := filter.clone()
+
+		assert.True(t, filter.IsZeroAfter(keys))
+		assert.True(t, filter.bucketsEqual(exp), "filter was modified")
+	})
 }
 
-func TestIbf_Delete(t *testing.T) {
+func TestIbf_clone(t *testing.T) {
+	filter := NewIbf(16)
+	filter.Add(generateData())
+
+	c := filter.clone()
+	c.Add(generateData())
 
+	assert.Equal(t, filter.K, c.K)
+	assert.Equal(t, filter.Seed, c.Seed)
+	assert.False(t, filter.bucketsEqual(c), "clone shares buckets with the original")
 }
 
 func TestIbf_Subtract(t *testing.T) {
+	t.Run("self-subtraction", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.Add(generateData())
+		filter.DetectSelfSubtraction = true
+		exp := filter.clone()
+
+		assert.ErrorIs(t, filter.Subtract(filter), ErrSelfSubtraction)
+		assert.ErrorIs(t, filter.Subtract(filter.clone()), ErrSelfSubtraction)
+		assert.True(t, filter.Equals(exp), "filter was modified")
+	})
+
+	t.Run("self-subtraction not detected by default", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.Add(generateData())
+
+		assert.NoError(t, filter.Subtract(filter.clone()))
+		assert.True(t, filter.IsEmpty())
+	})
+
+	t.Run("SubtractAndMeasure", func(t *testing.T) {
+		ibfA, ibfB := NewIbf(256), NewIbf(256)
+		keysA, keysB := generateSets(60, 40)
+		for n := range keysA {
+			ibfA.Add(keysA[n])
+			ibfB.Add(keysB[n])
+		}
+
+		nonEmpty, err := ibfA.SubtractAndMeasure(ibfB)
+
+		assert.NoError(t, err)
+		assert.Equal(t, ibfA.NonEmptyBucketCount(), nonEmpty)
+		assert.Greater(t, nonEmpty, 0)
+
+		nonEmpty, err = ibfA.SubtractAndMeasure(ibfA.clone())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, nonEmpty)
+
+		_, err = ibfA.SubtractAndMeasure(NewIbf(64))
+		assert.Error(t, err)
+	})
 
+	t.Run("different filters", func(t *testing.T) {
+		ibfA, ibfB := NewIbf(64), NewIbf(64)
+		ibfA.DetectSelfSubtraction = true
+		ibfA.Add(generateData())
+
+		assert.NoError(t, ibfA.Subtract(ibfB))
+	})
 }
 
 func TestIbf_Decode(t *testing.T) {
+	t.Run("undersized", func(t *testing.T) {
+		ibfA, ibfB := NewIbf(64), NewIbf(64)
+		for n := 0; n < 100; n++ {
+			ibfA.Add(generateData())
+			ibfB.Add(generateData())
+		}
+		assert.NoError(t, ibfA.Subtract(ibfB))
+
+		_, _, err := ibfA.Decode()
+
+		assert.ErrorIs(t, err, ErrDecodeUndersized)
+		assert.ErrorIs(t, err, ErrDecodeFailed)
+	})
+
+	t.Run("undersized with structured keys", func(t *testing.T) {
+		// consecutive ids have subsets that xor to zero, which leaves stuck buckets with a zero keySum
+		for start := uint64(0); start < 2000; start += 80 {
+			filter := NewIbf(64)
+			ids := make([]uint64, 80)
+			for n := range ids {
+				ids[n] = start + uint64(n)
+			}
+			assert.NoError(t, filter.AddUint64s(ids))
+
+			_, _, err := filter.Decode()
+
+			assert.ErrorIs(t, err, ErrDecodeUndersized, "ids from %d", start)
+		}
+	})
+
+	t.Run("corrupt count of a single key", func(t *testing.T) {
+		filter := NewIbf(64)
+		key := generateData()
+		filter.Add(key)
+		idx := filter.IndicesFor(key)[0]
+		filter.Buckets.Get(int(idx)).count = 2
+
+		_, _, err := filter.Decode()
+
+		assert.ErrorIs(t, err, ErrDecodeCorrupt)
+		assert.ErrorIs(t, err, ErrDecodeFailed)
+		assert.NotErrorIs(t, err, ErrDecodeUndersized)
+	})
+
+	t.Run("corrupt hashSum", func(t *testing.T) {
+		for _, numKeys := range []int{1, 20} {
+			filter := NewIbf(64)
+			key := generateData()
+			filter.Add(key)
+			for n := 1; n < numKeys; n++ {
+				filter.Add(generateData())
+			}
+			idx := filter.IndicesFor(key)[0]
+			filter.Buckets.Get(int(idx)).hashSum ^= 1 << 17
+
+			_, _, err := filter.Decode()
+
+			assert.ErrorIs(t, err, ErrDecodeCorrupt, "%d keys", numKeys)
+		}
+	})
+
+	t.Run("corrupt count", func(t *testing.T) {
+		filter := NewIbf(64)
+		for n := 0; n < 200; n++ {
+			filter.Add(generateData())
+		}
+		filter.Buckets.Get(0).count++
+
+		_, _, err := filter.Decode()
+
+		assert.ErrorIs(t, err, ErrDecodeCorrupt)
+	})
+}
+
+func TestIbf_DecodeFailureHook(t *testing.T) {
+	var captured [][]byte
+	hook := func(serialized []byte) {
+		captured = append(captured, serialized)
+	}
+
+	t.Run("decode failure", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.DecodeFailureHook = hook
+		for n := 0; n < 100; n++ {
+			filter.Add(generateData())
+		}
+		exp := filter.clone()
+
+		result := filter.DecodeFull()
+
+		assert.ErrorIs(t, result.Err, ErrDecodeUndersized)
+		assert.Len(t, captured, 1)
+		reloaded := &ibf{}
+		assert.NoError(t, reloaded.UnmarshalBinary(captured[0]))
+		assert.True(t, reloaded.Equals(exp), "filter before decoding is captured")
+		again := reloaded.DecodeFull()
+		assert.Equal(t, result.Err, again.Err)
+		assert.Equal(t, result.StuckCore, again.StuckCore)
+		assert.ElementsMatch(t, result.Remaining, again.Remaining)
+	})
+
+	t.Run("not called on success or deadline", func(t *testing.T) {
+		captured = nil
+		filter := NewIbf(64)
+		filter.DecodeFailureHook = hook
+		filter.Add(generateData())
+
+		_, _, err := filter.clone().Decode()
+		assert.NoError(t, err)
+		_, _, err = filter.DecodeWithDeadline(time.Now().Add(-time.Second))
+		assert.ErrorIs(t, err, ErrDeadlineExceeded)
+
+		assert.Empty(t, captured)
+	})
+}
+
+func TestIbf_DecodeFull(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		ibfA, ibfB := NewIbf(64), NewIbf(64)
+		a, b := generateData(), generateData()
+		ibfA.Add(a)
+		ibfB.Add(b)
+		assert.NoError(t, ibfA.Subtract(ibfB))
+
+		result := ibfA.DecodeFull()
+
+		assert.NoError(t, result.Err)
+		assert.Equal(t, [][]byte{a}, result.Remaining)
+		assert.Equal(t, [][]byte{b}, result.Missing)
+		assert.Less(t, 0, result.Iterations)
+		assert.Equal(t, 0, result.StuckCore)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		filter := NewIbf(8)
+		for n := 0; n < 32; n++ {
+			filter.Add(generateData())
+		}
+
+		result := filter.DecodeFull()
+
+		assert.Error(t, result.Err)
+		assert.Less(t, 0, result.Iterations)
+		assert.Less(t, 0, result.StuckCore)
+		assert.LessOrEqual(t, result.StuckCore, 8)
+	})
+}
+
+func TestIbf_Decode_deterministic(t *testing.T) {
+	// at this load most buckets are pure at the same time
+	keys := make([][]byte, 50)
+	for idx := range keys {
+		keys[idx] = generateData()
+	}
+	inOrder, reversed := NewIbf(4096), NewIbf(4096)
+	for idx := range keys {
+		inOrder.Add(keys[idx])
+		reversed.Add(keys[len(keys)-1-idx])
+	}
+	assert.Greater(t, inOrder.Stats().Pure, len(keys))
+
+	exp, _, err := inOrder.clone().Decode()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, keys, exp)
+	for n := 0; n < 5; n++ {
+		remaining, _, err := inOrder.clone().Decode()
+		assert.NoError(t, err)
+		assert.Equal(t, exp, remaining, "decode order is not stable")
+	}
+	remaining, _, err := reversed.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, exp, remaining, "decode order depends on insertion order")
+}
+
+func TestIbf_SkipHashVerification(t *testing.T) {
+	filter := NewIbf(256)
+	filter.SkipHashVerification = true
+	var keys [][]byte
+	for n := 0; n < 100; n++ {
+		key := generateData()
+		keys = append(keys, key)
+		filter.Add(key)
+	}
+
+	remaining, missing, err := filter.Decode()
+
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+	assert.NoError(t, compareKeys(keys, remaining))
+	assert.True(t, filter.IsEmpty())
+}
+
+func TestIbf_PeelStrategy(t *testing.T) {
+	a, b := generateSets(300, 200)
+	filterA, filterB := NewIbf(1024), NewIbf(1024)
+	for n := range a {
+		filterA.Add(a[n])
+		filterB.Add(b[n])
+	}
+	filterA.Subtract(filterB)
+	expectedRemaining, expectedMissing := symmetricDifference(a, b)
+
+	for _, strategy := range []PeelStrategy{PeelSliceOrder, PeelFIFO, PeelLIFO} {
+		filter := filterA.clone()
+		filter.PeelStrategy = strategy
+
+		result := filter.DecodeFull()
+
+		assert.NoError(t, result.Err, "strategy %d", strategy)
+		assert.NoError(t, compareKeys(expectedRemaining, result.Remaining), "strategy %d", strategy)
+		assert.NoError(t, compareKeys(expectedMissing, result.Missing), "strategy %d", strategy)
+		assert.True(t, filter.IsEmpty())
+	}
+
+	t.Run("undecodable", func(t *testing.T) {
+		filter := NewIbf(16)
+		filter.PeelStrategy = PeelFIFO
+		for n := 0; n < 32; n++ {
+			filter.Add(generateData())
+		}
+
+		result := filter.DecodeFull()
+
+		assert.Error(t, result.Err)
+		assert.Greater(t, result.StuckCore, 0)
+	})
+}
+
+func TestIbf_DecodeInto(t *testing.T) {
+	filter := NewIbf(128)
+	for n := 0; n < 20; n++ {
+		filter.Add(generateData())
+	}
+	filter.Delete(generateData())
+	expRemaining, expMissing, expErr := filter.clone().Decode()
+
+	existing := generateData()
+	remaining, missing := [][]byte{existing}, make([][]byte, 0, 8)
+	err := filter.DecodeInto(&remaining, &missing)
+
+	assert.Equal(t, expErr, err)
+	assert.Equal(t, existing, remaining[0], "existing entries must be kept")
+	assert.Equal(t, expRemaining, remaining[1:])
+	assert.Equal(t, expMissing, missing)
+}
+
+func TestIbf_DecodeWithDeadline(t *testing.T) {
+	numKeys := 2000
+	newFilter := func() *ibf {
+		filter := NewIbf(2 * numKeys)
+		for n := 0; n < numKeys; n++ {
+			filter.Add(generateData())
+		}
+		return filter
+	}
+
+	t.Run("deadline exceeded", func(t *testing.T) {
+		remaining, missing, err := newFilter().DecodeWithDeadline(time.Now().Add(-time.Second))
+
+		assert.ErrorIs(t, err, ErrDeadlineExceeded)
+		assert.NotEmpty(t, remaining, "expected partial results")
+		assert.LessOrEqual(t, len(remaining), numKeys)
+		assert.Empty(t, missing)
+	})
+
+	t.Run("deadline not exceeded", func(t *testing.T) {
+		remaining, _, err := newFilter().DecodeWithDeadline(time.Now().Add(time.Hour))
+
+		assert.NoError(t, err)
+		assert.Len(t, remaining, numKeys)
+	})
+}
+
+func TestIbf_DecodeWithProgress(t *testing.T) {
+	numKeys := 200
+	filter := NewIbf(2 * numKeys)
+	for n := 0; n < numKeys; n++ {
+		filter.Add(generateData())
+	}
+	var iterations, peeled []int
+
+	remaining, _, err := filter.DecodeWithProgress(func(iteration, peeledSoFar int) {
+		iterations = append(iterations, iteration)
+		peeled = append(peeled, peeledSoFar)
+	})
+
+	assert.NoError(t, err)
+	assert.Greater(t, len(iterations), 1)
+	for n := 1; n < len(iterations); n++ {
+		assert.Equal(t, iterations[n-1]+1, iterations[n])
+		assert.Greater(t, peeled[n], peeled[n-1])
+	}
+	assert.Equal(t, len(remaining), peeled[len(peeled)-1])
+}
+
+func TestIbf_DecodeAdditionsOnly(t *testing.T) {
+	local, remote := NewIbf(128), NewIbf(128)
+	var added [][]byte
+	for n := 0; n < 20; n++ {
+		key := generateData()
+		local.Add(key)
+		remote.Add(key)
+	}
+	for n := 0; n < 5; n++ {
+		key := generateData()
+		remote.Add(key)
+		added = append(added, key)
+	}
+
+	t.Run("append-only", func(t *testing.T) {
+		diff := local.clone()
+		assert.NoError(t, diff.Subtract(remote))
+
+		missing, err := diff.DecodeAdditionsOnly()
+
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, added, missing)
+	})
+
+	t.Run("deletion", func(t *testing.T) {
+		diff := local.clone()
+		diff.Add(generateData())
+		assert.NoError(t, diff.Subtract(remote))
+
+		_, err := diff.DecodeAdditionsOnly()
+
+		assert.ErrorIs(t, err, ErrNotAppendOnly)
+	})
+}
+
+func TestIbf_Stats(t *testing.T) {
+	filter := NewIbf(64)
+	assert.Equal(t, Stats{Buckets: 64}, filter.Stats())
+	assert.True(t, filter.IsEmpty())
+
+	filter.Add(generateData())
+	stats := filter.Stats()
+
+	assert.False(t, filter.IsEmpty())
+	assert.Equal(t, 64, stats.Buckets)
+	assert.Equal(t, filter.K, stats.NonEmpty)
+	assert.Equal(t, filter.K, stats.Pure)
+	assert.Equal(t, filter.K, stats.Count)
+}
+
+func TestIbf_LoadEntropy(t *testing.T) {
+	distributed, clustered := NewIbf(64), NewIbf(64)
+	key := generateData()
+	for n := 0; n < 1000; n++ {
+		distributed.Add(generateData())
+		clustered.Add(key)
+	}
+
+	assert.Greater(t, distributed.LoadEntropy(), 0.95)
+	// all keys in K of 64 buckets
+	assert.InDelta(t, math.Log(4)/math.Log(64), clustered.LoadEntropy(), 1e-9)
+	assert.Equal(t, 0.0, NewIbf(64).LoadEntropy())
+}
+
+func TestNewIbfAutoSeed(t *testing.T) {
+	// keys that all hash to bucket 0 with the default seed
+	reference := NewIbf(64)
+	var sample [][]byte
+	for len(sample) < 50 {
+		key := generateData()
+		for _, h := range reference.IndicesFor(key) {
+			if h == 0 {
+				sample = append(sample, key)
+				reference.Add(key)
+			}
+		}
+	}
+
+	filter := NewIbfAutoSeed(64, sample)
+
+	assert.NotEqual(t, defaultSeed, filter.Seed)
+	assert.True(t, filter.IsEmpty(), "sample keys are not added")
+	for _, key := range sample {
+		filter.Add(key)
+	}
+	assert.Greater(t, filter.LoadEntropy(), reference.LoadEntropy())
+	assert.Equal(t, filter.Seed, NewIbfAutoSeed(64, sample).Seed, "deterministic")
+	assert.Equal(t, defaultSeed, NewIbfAutoSeed(64, nil).Seed, "default seed for ties")
+}
+
+func TestIbf_IsLikelySaturated(t *testing.T) {
+	numBuckets := 1024
+	fill := func(filter *ibf, n int) *ibf {
+		for idx := 0; idx < n; idx++ {
+			filter.Add(generateData())
+		}
+		return filter
+	}
+
+	assert.False(t, NewIbf(numBuckets).IsLikelySaturated(), "empty")
+	assert.False(t, fill(NewIbf(numBuckets), numBuckets/3).IsLikelySaturated(), "well-sized")
+	assert.True(t, fill(NewIbf(numBuckets), 2*numBuckets).IsLikelySaturated(), "overloaded")
+
+	t.Run("subtracted", func(t *testing.T) {
+		overloaded, wellSized := fill(NewIbf(numBuckets), numBuckets), fill(NewIbf(numBuckets), numBuckets/6)
+		assert.NoError(t, overloaded.Subtract(fill(NewIbf(numBuckets), numBuckets)))
+		assert.NoError(t, wellSized.Subtract(fill(NewIbf(numBuckets), numBuckets/6)))
 
+		assert.True(t, overloaded.IsLikelySaturated())
+		assert.False(t, wellSized.IsLikelySaturated())
+	})
+
+	t.Run("K equals the number of buckets", func(t *testing.T) {
+		filter := NewIbf(4)
+		filter.K = 4
+
+		assert.False(t, filter.IsLikelySaturated())
+		filter.Add(generateData())
+		assert.Equal(t, 1., filter.estimateKeys())
+		assert.True(t, fill(filter, 4).IsLikelySaturated())
+		assert.Equal(t, 5., filter.estimateKeys())
+	})
+}
+
+func TestIbf_FalsePureProbability(t *testing.T) {
+	filter := NewIbf(64)
+
+	assert.Equal(t, 0.0, filter.FalsePureProbability(1))
+	assert.Less(t, filter.FalsePureProbability(1000), filter.FalsePureProbability(1000000))
+	assert.InDelta(t, 1000*999/2/math.Exp2(64), filter.FalsePureProbability(1000), 1e-20)
+	assert.Less(t, falsePureProbability(1000, 64), falsePureProbability(1000, 32))
+	assert.InDelta(t, 1.0, falsePureProbability(1000000, 16), 1e-9)
 }
 
 func TestIbf_hashKey(t *testing.T) {
 
 }
 
+func TestIbf_Salt(t *testing.T) {
+	key := generateData()
+	salted, other := NewIbf(1024), NewIbf(1024)
+	salted.Salt = []byte("secret")
+	other.Salt = []byte("other secret")
+
+	t.Run("changes bucket assignment", func(t *testing.T) {
+		assert.NotEqual(t, NewIbf(1024).IndicesFor(key), salted.IndicesFor(key))
+		assert.NotEqual(t, other.IndicesFor(key), salted.IndicesFor(key))
+	})
+
+	t.Run("different salts refuse to subtract", func(t *testing.T) {
+		assert.Error(t, salted.clone().Subtract(other))
+		assert.Error(t, salted.clone().Subtract(NewIbf(1024)))
+	})
+
+	t.Run("decode", func(t *testing.T) {
+		a, b := salted.clone(), salted.clone()
+		a.Add(key)
+		assert.NoError(t, a.Subtract(b))
+
+		remaining, _, err := a.Decode()
+
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{key}, remaining)
+	})
+}
+
+func TestIbf_Epoch(t *testing.T) {
+	a, b := NewIbf(64), NewIbf(64)
+	a.SetEpoch(2)
+	b.SetEpoch(3)
+
+	t.Run("unchecked by default", func(t *testing.T) {
+		assert.NoError(t, a.clone().Subtract(b))
+	})
+
+	t.Run("mismatch refuses to subtract", func(t *testing.T) {
+		checked := a.clone()
+		checked.CheckEpoch = true
+
+		assert.EqualError(t, checked.Subtract(b), "subtraction failed: epochs do not match, expected (2) got (3)")
+		b.SetEpoch(2)
+		assert.NoError(t, checked.Subtract(b))
+	})
+
+	t.Run("serialized", func(t *testing.T) {
+		data, err := a.MarshalBinary()
+		assert.NoError(t, err)
+		decoded := &ibf{}
+		assert.NoError(t, decoded.UnmarshalBinary(data))
+		assert.Equal(t, uint64(2), decoded.Epoch())
+
+		data, err = MarshalJson(a)
+		assert.NoError(t, err)
+		decoded, err = UnmarshalJson(data)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), decoded.Epoch())
+	})
+}
+
+func TestSeed(t *testing.T) {
+	t.Run("DeriveFrom is deterministic", func(t *testing.T) {
+		assert.Equal(t, DeriveFrom("tx"), DeriveFrom("tx"))
+		assert.NotEqual(t, DeriveFrom("tx"), DeriveFrom("blocks"))
+	})
+
+	t.Run("NewIbfWithSeed", func(t *testing.T) {
+		seed := DeriveFrom("tx")
+		filter := NewIbfWithSeed(64, seed)
+
+		assert.Equal(t, seed, filter.Seed)
+		assert.Error(t, filter.Subtract(NewIbf(64)), "seeds differ")
+		assert.NoError(t, filter.Subtract(NewIbfWithSeed(64, seed)))
+	})
+}
+
 func TestIbf_bucketIndices(t *testing.T) {
 
 }
 
+func TestIbf_DiffReusable(t *testing.T) {
+	local := NewIbf(64)
+	local.PreserveLength = true
+	localKey := generateData()[:20]
+	local.Add(localKey)
+	scratch := NewIbf(64)
+	scratch.PreserveLength = true
+
+	for n := 0; n < 3; n++ {
+		remote := NewIbf(64)
+		remote.PreserveLength = true
+		remoteKey := generateData()
+		remote.Add(remoteKey)
+
+		remaining, missing, err := local.DiffReusable(remote, scratch)
+
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{localKey}, remaining)
+		assert.Equal(t, [][]byte{remoteKey}, missing)
+	}
+	assert.True(t, local.MayContain(localKey), "local filter is not modified")
+
+	t.Run("incompatible", func(t *testing.T) {
+		_, _, err := local.DiffReusable(NewIbf(32), scratch)
+		assert.Error(t, err)
+
+		_, _, err = local.DiffReusable(NewIbf(64), NewIbf(64))
+		assert.EqualError(t, err, "diff failed: incompatible scratch filter: PreserveLength does not match")
+	})
+}
+
+func TestIbf_DiffMultiplicities(t *testing.T) {
+	for _, retainKeys := range []bool{false, true} {
+		a, b := NewIbf(256), NewIbf(256)
+		a.RetainKeys, b.RetainKeys = retainKeys, retainKeys
+		onlyA, onlyB, once, twice := generateData(), generateData(), generateData(), generateData()
+		a.Add(onlyA)
+		a.Add(once)
+		a.Add(twice)
+		a.Add(twice)
+		b.Add(onlyB)
+		b.Add(once)
+		b.Add(once)
+		b.Add(twice)
+
+		remaining, missing, mismatched, err := a.DiffMultiplicities(b)
+
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{onlyA}, remaining, "retain keys: %v", retainKeys)
+		assert.Equal(t, [][]byte{onlyB}, missing, "retain keys: %v", retainKeys)
+		assert.NoError(t, compareKeys([][]byte{once, twice}, mismatched), "retain keys: %v", retainKeys)
+	}
+}
+
+func TestIbf_DiffMask(t *testing.T) {
+	numBuckets := 128
+	ibfA, ibfB := NewIbf(numBuckets), NewIbf(numBuckets)
+	for n := 0; n < 20; n++ {
+		shared := generateData()
+		ibfA.Add(shared)
+		ibfB.Add(shared)
+	}
+	a, b := generateData(), generateData()
+	ibfA.Add(a)
+	ibfB.Add(b)
+	affected := map[uint64]bool{}
+	for _, h := range ibfA.bucketIndices(ibfA.hashKey(a)) {
+		affected[h] = true
+	}
+	for _, h := range ibfB.bucketIndices(ibfB.hashKey(b)) {
+		affected[h] = true
+	}
+
+	mask, err := ibfA.DiffMask(ibfB)
+
+	assert.NoError(t, err)
+	assert.Len(t, mask, numBuckets)
+	for idx, differs := range mask {
+		assert.Equal(t, affected[uint64(idx)], differs, "bucket %d", idx)
+	}
+
+	t.Run("incompatible", func(t *testing.T) {
+		_, err := ibfA.DiffMask(NewIbf(numBuckets / 2))
+		assert.Error(t, err)
+	})
+}
+
+func TestIbf_Equals(t *testing.T) {
+	ibfA, ibfB := NewIbf(64), NewIbf(64)
+	assert.True(t, ibfA.Equals(ibfB))
+
+	key := generateData()
+	ibfA.Add(key)
+	assert.False(t, ibfA.Equals(ibfB), "different buckets")
+
+	ibfB.Add(key)
+	ibfB.K = 3
+	assert.False(t, ibfA.Equals(ibfB), "different parameters")
+}
+
+func TestIbf_Fingerprint(t *testing.T) {
+	a, b := NewIbf(64), NewIbf(64)
+	for n := 0; n < 10; n++ {
+		key := generateData()
+		a.Add(key)
+		b.Add(key)
+	}
+	assert.Equal(t, a.Fingerprint(), b.Fingerprint())
+
+	key := generateData()
+	b.Add(key)
+	assert.NotEqual(t, a.Fingerprint(), b.Fingerprint())
+
+	b.Delete(key)
+	assert.Equal(t, a.Fingerprint(), b.Fingerprint())
+}
+
+func TestSameSetEqual(t *testing.T) {
+	a, b := generateData(), generateData()
+
+	assert.True(t, SameSetEqual([][]byte{a, b}, [][]byte{b, a}, 64))
+	assert.False(t, SameSetEqual([][]byte{a, b}, [][]byte{a}, 64))
+	assert.False(t, SameSetEqual([][]byte{make([]byte, keyLength+1)}, nil, 64), "invalid key")
+}
+
+func FuzzSameSetEqual(f *testing.F) {
+	f.Add([]byte("the quick brown fox jumps over the lazy dog"), int64(1))
+	f.Add(generateData(), int64(2))
+	f.Fuzz(func(t *testing.T, data []byte, seed int64) {
+		// split the data into keys of up to 8 bytes
+		var keys [][]byte
+		for len(data) > 0 {
+			n := 8
+			if len(data) < n {
+				n = len(data)
+			}
+			keys = append(keys, data[:n])
+			data = data[n:]
+		}
+		permuted := append([][]byte{}, keys...)
+		rand.New(rand.NewSource(seed)).Shuffle(len(permuted), func(i, j int) {
+			permuted[i], permuted[j] = permuted[j], permuted[i]
+		})
+
+		if !SameSetEqual(keys, permuted, 16) {
+			t.Errorf("insertion order changed the filter of %x", keys)
+		}
+	})
+}
+
 func TestIbf_validateSubtrahend(t *testing.T) {
 
 }
 
 func TestIbf_JsonMarshalling(t *testing.T) {
+	filter := NewIbf(16)
+	filter.Add(generateData())
+
+	data, err := MarshalJson(filter)
+	assert.NoError(t, err)
+	decoded, err := UnmarshalJson(data)
 
+	assert.NoError(t, err)
+	assert.Equal(t, filter, decoded)
 }
 
 // Test bucket
@@ -86,6 +1780,13 @@ func TestBucket(t *testing.T) {
 		assert.True(t, b.isEmpty(), "bucket is empty")
 	})
 
+	t.Run("isEmpty", func(t *testing.T) {
+		assert.False(t, testBucket(1, make([]byte, keyLength), 0).isEmpty(), "count")
+		assert.False(t, testBucket(0, []byte{0, 1}, 0).isEmpty(), "keySum")
+		assert.False(t, testBucket(0, make([]byte, keyLength), 1).isEmpty(), "hashSum")
+		assert.True(t, testBucket(0, nil, 0).isEmpty(), "no keySum")
+	})
+
 	t.Run("update() applies XOR operation on keySum and hashSum", func(t *testing.T) {
 		b := testBucket(0, keyXor, hashXor)
 		exp := testBucket(0, key1, hash1)
@@ -124,12 +1825,8 @@ func TestBucket(t *testing.T) {
 	})
 }
 
-func (b *bucket) equals(o *bucket) bool {
-	return b.count == o.count && b.hashSum == o.hashSum && eq(b.keySum, o.keySum)
-}
-
-func testBucket(count int, keySum []byte, hashSum uint64) *bucket {
-	return &bucket{
+func testBucket(count int, keySum []byte, hashSum uint64) *Bucket {
+	return &Bucket{
 		count:   count,
 		keySum:  keySum,
 		hashSum: hashSum,
@@ -0,0 +1,54 @@
+package bloom
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spaolacci/murmur3"
+	"math"
+)
+
+// MinHashEstimator estimates the Jaccard similarity J = |A ∩ B| / |A ∪ B| of two sets.
+//
+// It is meant as a fallback for reconciliation: when decoding fails, the similarity bounds the size of the set
+// difference, |A Δ B| = (|A| + |B|) * (1 - J) / (1 + J). If that is larger than any reasonably sized ibf can decode,
+// the caller should do a full transfer instead of retrying with ever larger filters.
+// The standard error of the estimate is sqrt(J * (1 - J) / numHashes).
+type MinHashEstimator struct {
+	// mins holds the minimum hash value of all added keys for each hash function
+	mins []uint64
+}
+
+// NewMinHashEstimator creates an estimator using numHashes hash functions.
+func NewMinHashEstimator(numHashes int) *MinHashEstimator {
+	mins := make([]uint64, numHashes)
+	for i := range mins {
+		mins[i] = math.MaxUint64
+	}
+	return &MinHashEstimator{mins: mins}
+}
+
+// Add adds the key to the estimator.
+func (m *MinHashEstimator) Add(key []byte) {
+	for i := range m.mins {
+		if h := murmur3.Sum64WithSeed(key, uint32(i)); h < m.mins[i] {
+			m.mins[i] = h
+		}
+	}
+}
+
+// SimilarityTo returns the estimated Jaccard similarity of the sets added to both estimators.
+func (m *MinHashEstimator) SimilarityTo(other *MinHashEstimator) (float64, error) {
+	if len(m.mins) != len(other.mins) {
+		return 0, fmt.Errorf("unequal number of hashes, expected (%d) got (%d)", len(m.mins), len(other.mins))
+	}
+	if len(m.mins) == 0 {
+		return 0, errors.New("estimator has no hashes")
+	}
+	matches := 0
+	for i := range m.mins {
+		if m.mins[i] == other.mins[i] {
+			matches++
+		}
+	}
+	return float64(matches) / float64(len(m.mins)), nil
+}
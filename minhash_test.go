@@ -0,0 +1,34 @@
+package bloom
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMinHashEstimator_SimilarityTo(t *testing.T) {
+	n := 1000
+	for _, shared := range []int{0, 250, 500, 750, n} {
+		a, b := generateSets(n, shared)
+		estA, estB := NewMinHashEstimator(512), NewMinHashEstimator(512)
+		for idx := range a {
+			estA.Add(a[idx])
+			estB.Add(b[idx])
+		}
+		jaccard := float64(shared) / float64(2*n-shared)
+
+		similarity, err := estA.SimilarityTo(estB)
+
+		assert.NoError(t, err)
+		assert.InDelta(t, jaccard, similarity, 0.1, "%d shared keys", shared)
+	}
+
+	t.Run("unequal number of hashes", func(t *testing.T) {
+		_, err := NewMinHashEstimator(16).SimilarityTo(NewMinHashEstimator(32))
+		assert.Error(t, err)
+	})
+
+	t.Run("no hashes", func(t *testing.T) {
+		_, err := NewMinHashEstimator(0).SimilarityTo(NewMinHashEstimator(0))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,37 @@
+package bloom
+
+// ReadOnlyIbf is a view of an ibf that only exposes operations that do not modify the filter. Use it to hand a filter to
+// code that should only read it, such as a decode-only consumer.
+type ReadOnlyIbf struct {
+	filter *ibf
+}
+
+// ReadOnly returns a read-only view of the filter.
+func (i *ibf) ReadOnly() ReadOnlyIbf {
+	return ReadOnlyIbf{filter: i}
+}
+
+// Decode decodes a clone of the underlying filter, which is left untouched.
+func (r ReadOnlyIbf) Decode() (remaining [][]byte, missing [][]byte, err error) {
+	return r.filter.clone().Decode()
+}
+
+func (r ReadOnlyIbf) IsEmpty() bool {
+	return r.filter.IsEmpty()
+}
+
+func (r ReadOnlyIbf) Stats() Stats {
+	return r.filter.Stats()
+}
+
+func (r ReadOnlyIbf) MarshalJSON() ([]byte, error) {
+	return MarshalJson(r.filter)
+}
+
+func (r ReadOnlyIbf) MarshalBinary() ([]byte, error) {
+	return r.filter.MarshalBinary()
+}
+
+func (r ReadOnlyIbf) MarshalCompressed(codec Codec) ([]byte, error) {
+	return r.filter.MarshalCompressed(codec)
+}
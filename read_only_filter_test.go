@@ -0,0 +1,46 @@
+package bloom
+
+import (
+	"github.com/stretchr/testify/assert"
+	"reflect"
+	"testing"
+)
+
+func TestReadOnlyIbf(t *testing.T) {
+	filter := NewIbf(64)
+	key := generateData()
+	filter.Add(key)
+	view := filter.ReadOnly()
+	exp := filter.clone()
+
+	t.Run("no mutating methods", func(t *testing.T) {
+		allowed := map[string]bool{"Decode": true, "IsEmpty": true, "Stats": true, "MarshalJSON": true, "MarshalBinary": true, "MarshalCompressed": true}
+		// the method set of the pointer includes the methods on the value
+		viewType := reflect.TypeOf(&view)
+		for m := 0; m < viewType.NumMethod(); m++ {
+			assert.True(t, allowed[viewType.Method(m).Name], "unexpected method %s", viewType.Method(m).Name)
+		}
+	})
+
+	t.Run("Decode does not modify the filter", func(t *testing.T) {
+		remaining, _, err := view.Decode()
+
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{key}, remaining)
+		assert.True(t, filter.Equals(exp), "filter was modified")
+	})
+
+	t.Run("IsEmpty and Stats", func(t *testing.T) {
+		assert.False(t, view.IsEmpty())
+		assert.True(t, NewIbf(64).ReadOnly().IsEmpty())
+		assert.Equal(t, filter.Stats(), view.Stats())
+	})
+
+	t.Run("serialization", func(t *testing.T) {
+		data, err := view.MarshalBinary()
+		assert.NoError(t, err)
+		decoded := &ibf{}
+		assert.NoError(t, decoded.UnmarshalBinary(data))
+		assert.True(t, decoded.Equals(filter))
+	})
+}
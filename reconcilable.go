@@ -0,0 +1,23 @@
+package bloom
+
+// Reconcilable is the contract of an invertible filter, so reconciliation code can work with other implementations
+// than the dense ibf, e.g. one backed by a memory-mapped file.
+type Reconcilable interface {
+	// Add inserts the key.
+	Add(key []byte) error
+	// Delete removes the key.
+	Delete(key []byte) error
+	// Subtract subtracts the other filter, implementations may only support subtrahends of their own type.
+	Subtract(other Reconcilable) error
+	// Decode peels the filter and returns the keys with a positive count (remaining) and negative count (missing).
+	Decode() (remaining [][]byte, missing [][]byte, err error)
+	// Clone returns a deep copy of the filter.
+	Clone() Reconcilable
+}
+
+var _ Reconcilable = (*ibf)(nil)
+
+// Clone returns a deep copy of the ibf backed by an in-memory store.
+func (i *ibf) Clone() Reconcilable {
+	return i.clone()
+}
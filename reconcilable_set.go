@@ -0,0 +1,99 @@
+package bloom
+
+import (
+	"fmt"
+	"math"
+)
+
+// ReconcilableSet combines a counting Bloom filter for membership tests with an ibf for reconciliation. Both are kept in
+// sync by Add and Delete, and share the hash of the key: the counters of a key are selected by a xorshift64 chain of
+// the mixed hash, see positions.
+type ReconcilableSet struct {
+	filter *ibf
+	// counters counts the keys hashed to each position of the membership filter
+	counters []uint32
+}
+
+// NewReconcilableSet creates a set with an ibf of numBuckets buckets and a membership filter of numCounters counters.
+// Like a Bloom filter, Contains has a false positive rate of about (1-e^(-K*n/numCounters))^K for n keys. The membership
+// filter has at least one counter.
+func NewReconcilableSet(numBuckets, numCounters int) *ReconcilableSet {
+	if numCounters < 1 {
+		numCounters = 1
+	}
+	return &ReconcilableSet{
+		filter:   NewIbf(numBuckets),
+		counters: make([]uint32, numCounters),
+	}
+}
+
+// Add adds the key to the set.
+func (s *ReconcilableSet) Add(key []byte) error {
+	prepared := s.filter.Prepare(key)
+	positions := s.positions(prepared.hash)
+	for _, p := range positions {
+		if s.counters[p] == math.MaxUint32 {
+			return fmt.Errorf("%w: counter overflow at position %d", ErrCorruptFilter, p)
+		}
+	}
+	if err := s.filter.AddPrepared(prepared); err != nil {
+		return err
+	}
+	for _, p := range positions {
+		s.counters[p]++
+	}
+	return nil
+}
+
+// Delete removes the key from the set. It returns ErrKeyNotFound if the set does not contain the key.
+func (s *ReconcilableSet) Delete(key []byte) error {
+	prepared := s.filter.Prepare(key)
+	positions := s.positions(prepared.hash)
+	if !s.contains(positions) {
+		return fmt.Errorf("%w: %x", ErrKeyNotFound, key)
+	}
+	if err := s.filter.DeletePrepared(prepared); err != nil {
+		return err
+	}
+	for _, p := range positions {
+		s.counters[p]--
+	}
+	return nil
+}
+
+// Contains reports whether the set may contain the key. A false result means the key is not in the set.
+func (s *ReconcilableSet) Contains(key []byte) bool {
+	return s.contains(s.positions(s.filter.Prepare(key).hash))
+}
+
+func (s *ReconcilableSet) contains(positions []uint64) bool {
+	for _, p := range positions {
+		if s.counters[p] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Diff returns the keys only in s (remaining) and only in other (missing). Both sets must have the same number of
+// buckets. Neither set is modified.
+func (s *ReconcilableSet) Diff(other *ReconcilableSet) (remaining [][]byte, missing [][]byte, err error) {
+	diff := s.filter.clone()
+	if err = diff.Subtract(other.filter); err != nil {
+		return nil, nil, err
+	}
+	return diff.Decode()
+}
+
+// positions returns the K counters of the hash. The chain starts from fmix64 of the hash: xorshift64 is linear, so a
+// chain starting from e.g. the inverted hash would only differ from the chain of the bucket indices by a constant,
+// while the non-linear fmix64 decorrelates the counters from the bucket indices.
+func (s *ReconcilableSet) positions(hash uint64) []uint64 {
+	positions := make([]uint64, s.filter.K)
+	next := xorshift64(fmix64(hash))
+	for n := range positions {
+		positions[n] = next % uint64(len(s.counters))
+		next = xorshift64(next)
+	}
+	return positions
+}
@@ -0,0 +1,69 @@
+package bloom
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestReconcilableSet(t *testing.T) {
+	local, remote := NewReconcilableSet(64, 1024), NewReconcilableSet(64, 1024)
+	shared, localOnly, remoteOnly, deleted := generateData(), generateData(), generateData(), generateData()
+	assert.NoError(t, local.Add(shared))
+	assert.NoError(t, local.Add(deleted))
+	assert.NoError(t, remote.Add(shared))
+	assert.NoError(t, local.Add(localOnly))
+	assert.NoError(t, remote.Add(deleted))
+	assert.NoError(t, local.Delete(deleted))
+	assert.NoError(t, remote.Add(remoteOnly))
+
+	t.Run("Contains", func(t *testing.T) {
+		assert.True(t, local.Contains(shared))
+		assert.True(t, local.Contains(localOnly))
+		assert.False(t, local.Contains(deleted))
+		assert.False(t, local.Contains(remoteOnly))
+		assert.True(t, remote.Contains(deleted))
+	})
+
+	t.Run("Diff", func(t *testing.T) {
+		remaining, missing, err := local.Diff(remote)
+
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{localOnly}, remaining)
+		assert.NoError(t, compareKeys([][]byte{remoteOnly, deleted}, missing))
+	})
+
+	t.Run("delete absent key", func(t *testing.T) {
+		err := local.Delete(generateData())
+
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		remaining, _, _ := local.Diff(remote)
+		assert.Len(t, remaining, 1, "set is not modified")
+	})
+
+	t.Run("incompatible", func(t *testing.T) {
+		_, _, err := local.Diff(NewReconcilableSet(32, 1024))
+
+		assert.Error(t, err)
+	})
+
+	t.Run("counters are not correlated with buckets", func(t *testing.T) {
+		set := NewReconcilableSet(64, 64)
+		offsets := map[uint64]bool{}
+		for n := 0; n < 100; n++ {
+			prepared := set.filter.Prepare(generateData())
+			offsets[prepared.indices[0]^set.positions(prepared.hash)[0]] = true
+		}
+
+		assert.Greater(t, len(offsets), 1, "positions are the bucket indices xor a constant")
+	})
+
+	t.Run("no counters", func(t *testing.T) {
+		set := NewReconcilableSet(64, 0)
+		key := generateData()
+
+		assert.NoError(t, set.Add(key))
+		assert.True(t, set.Contains(key))
+		assert.NoError(t, set.Delete(key))
+		assert.Len(t, set.counters, 1)
+	})
+}
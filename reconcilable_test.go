@@ -0,0 +1,40 @@
+package bloom
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// diffReconcilable reconciles through the interface only
+func diffReconcilable(local, remote Reconcilable) ([][]byte, [][]byte, error) {
+	diff := local.Clone()
+	if err := diff.Subtract(remote); err != nil {
+		return nil, nil, err
+	}
+	return diff.Decode()
+}
+
+func TestReconcilable(t *testing.T) {
+	var local, remote Reconcilable = NewIbf(64), NewIbf(64)
+	shared, localOnly, remoteOnly, deleted := generateData(), generateData(), generateData(), generateData()
+	assert.NoError(t, local.Add(shared))
+	assert.NoError(t, local.Add(localOnly))
+	assert.NoError(t, local.Add(deleted))
+	assert.NoError(t, local.Delete(deleted))
+	assert.NoError(t, remote.Add(shared))
+	assert.NoError(t, remote.Add(remoteOnly))
+
+	remaining, missing, err := diffReconcilable(local, remote)
+
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{localOnly}, remaining)
+	assert.Equal(t, [][]byte{remoteOnly}, missing)
+	_, _, err = local.Decode()
+	assert.NoError(t, err, "the clone was subtracted")
+
+	t.Run("other implementation", func(t *testing.T) {
+		err := NewIbf(64).Subtract(NewIbfDebug(64))
+
+		assert.EqualError(t, err, "subtraction failed: cannot subtract *bloom.debugIbf")
+	})
+}
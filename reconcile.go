@@ -0,0 +1,480 @@
+package bloom
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// CheckReconcile verifies the property an ibf must satisfy: subtracting the filter of remoteKeys from the filter of
+// localKeys decodes to exactly the symmetric difference of both key sets. Keys must be unique within each set and
+// keyLength bytes long. Returns a descriptive error if the reconciliation fails or recovers the wrong keys.
+func CheckReconcile(localKeys, remoteKeys [][]byte, numBuckets int) error {
+	local, remote := NewIbf(numBuckets), NewIbf(numBuckets)
+	for _, key := range localKeys {
+		if err := local.Add(key); err != nil {
+			return fmt.Errorf("reconcile failed: %w", err)
+		}
+	}
+	for _, key := range remoteKeys {
+		if err := remote.Add(key); err != nil {
+			return fmt.Errorf("reconcile failed: %w", err)
+		}
+	}
+	if err := local.Subtract(remote); err != nil {
+		return fmt.Errorf("reconcile failed: %w", err)
+	}
+	remaining, missing, err := local.Decode()
+	if err != nil {
+		return fmt.Errorf("reconcile failed: %w", err)
+	}
+	if err = VerifyReconciliation(localKeys, remoteKeys, remaining, missing); err != nil {
+		return fmt.Errorf("reconcile failed: %w", err)
+	}
+	return nil
+}
+
+// VerifyReconciliation checks a decoded difference against the key sets it was built from: remaining must hold exactly
+// the keys only in localKeys and missing exactly the keys only in remoteKeys, each once. The symmetric difference is
+// computed by brute force, so this is meant for tests and deployments that keep both key sets. The error lists every
+// false positive (a key that should not be in the list), false negative (a key the list lacks) and duplicate.
+func VerifyReconciliation(localKeys, remoteKeys, remaining, missing [][]byte) error {
+	localOnly, remoteOnly := symmetricDifference(localKeys, remoteKeys)
+	problems := append(keyMismatches("remaining", localOnly, remaining), keyMismatches("missing", remoteOnly, missing)...)
+	if len(problems) > 0 {
+		return fmt.Errorf("verification failed: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// keyMismatches describes the false positives, false negatives and duplicates of actual compared to expected.
+func keyMismatches(name string, expected, actual [][]byte) []string {
+	var problems []string
+	exp, seen := keySet(expected), map[string]bool{}
+	for _, key := range actual {
+		switch {
+		case seen[string(key)]:
+			problems = append(problems, fmt.Sprintf("%s: duplicate %x", name, key))
+		case !exp[string(key)]:
+			problems = append(problems, fmt.Sprintf("%s: false positive %x", name, key))
+		}
+		seen[string(key)] = true
+	}
+	for _, key := range expected {
+		if !seen[string(key)] {
+			problems = append(problems, fmt.Sprintf("%s: false negative %x", name, key))
+		}
+	}
+	return problems
+}
+
+// maxReconcileGrowth is the number of times ReconcileWith doubles the number of buckets before giving up
+const maxReconcileGrowth = 5
+
+// ReconcileWith returns the keys that are only retained by i (remaining) and only by other (missing). Both filters
+// must have RetainKeys set, since the filters are rebuilt from the retained keys. If the difference cannot be decoded,
+// the filters are rebuilt with the values of i.KSweep for K, and then with twice the number of buckets, up to
+// maxReconcileGrowth times. Neither filter is modified.
+func (i *ibf) ReconcileWith(other *ibf) (remaining [][]byte, missing [][]byte, err error) {
+	remaining, missing, _, _, err = i.reconcileWith(other)
+	return remaining, missing, err
+}
+
+// reconcileWith implements ReconcileWith and also returns the number of buckets and K of the decoded difference.
+func (i *ibf) reconcileWith(other *ibf) (remaining, missing [][]byte, numBuckets, k int, err error) {
+	if !i.RetainKeys || !other.RetainKeys {
+		return nil, nil, 0, 0, errors.New("reconcile failed: filters do not retain their keys")
+	}
+	if err = i.validateSubtrahend(other); err != nil {
+		return nil, nil, 0, 0, fmt.Errorf("reconcile failed: %w", err)
+	}
+	ks := []int{i.K}
+	for _, k := range i.KSweep {
+		if k != i.K {
+			ks = append(ks, k)
+		}
+	}
+	numBuckets = i.Buckets.Len()
+	for growth := 0; ; growth++ {
+		for _, k = range ks {
+			if k < 1 || k > numBuckets {
+				continue
+			}
+			var local, remote *ibf
+			if local, err = i.fromRetainedKeys(numBuckets, k); err != nil {
+				return nil, nil, 0, 0, fmt.Errorf("reconcile failed: %w", err)
+			}
+			if remote, err = other.fromRetainedKeys(numBuckets, k); err != nil {
+				return nil, nil, 0, 0, fmt.Errorf("reconcile failed: %w", err)
+			}
+			if err = local.Subtract(remote); err != nil {
+				return nil, nil, 0, 0, fmt.Errorf("reconcile failed: %w", err)
+			}
+			if remaining, missing, err = local.Decode(); err == nil {
+				return remaining, missing, numBuckets, k, nil
+			}
+		}
+		if growth == maxReconcileGrowth {
+			return nil, nil, 0, 0, fmt.Errorf("reconcile failed with %d Buckets: %w", numBuckets, err)
+		}
+		numBuckets *= 2
+	}
+}
+
+// fromRetainedKeys builds a filter with numBuckets buckets and k hash functions from the keys retained by i.
+func (i *ibf) fromRetainedKeys(numBuckets, k int) (*ibf, error) {
+	newIbf := i.emptyCopy(numBuckets)
+	newIbf.K = k
+	newIbf.RetainKeys = false
+	for key, count := range i.keys {
+		for ; count > 0; count-- {
+			if err := newIbf.Add([]byte(key)); err != nil {
+				return nil, err
+			}
+		}
+		for ; count < 0; count++ {
+			if err := newIbf.Delete([]byte(key)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return newIbf, nil
+}
+
+// EstimateDifference estimates the size of the symmetric difference of the sets in a and b, e.g. to choose a tighter
+// filter size for the next round. Neither filter is modified.
+//
+// If a-b can be decoded, the number of recovered keys is returned, which is exact barring false pures. Otherwise, the
+// recovered keys are added to an estimate of the keys in the undecodable residue based on the variance of its bucket
+// counts. The relative error of this estimate is roughly sqrt(2/m) for m buckets.
+func EstimateDifference(a, b *ibf) (int, error) {
+	diff := a.clone()
+	if err := diff.Subtract(b); err != nil {
+		return 0, fmt.Errorf("estimate failed: %w", err)
+	}
+	result := diff.DecodeFull()
+	decoded := len(result.Remaining) + len(result.Missing)
+	if result.Err == nil {
+		return decoded, nil
+	}
+
+	return decoded + int(math.Round(diff.estimateKeys())), nil
+}
+
+// DiffSets returns the keys only in a and the keys only in b. It is the convenience entry point for sets held in
+// memory: the filters are sized by RecommendedBuckets for the worst case difference and grown if decoding fails
+// anyway. Duplicate keys are ignored and keys may have any length, sets with keys of MaxKeyLength bytes or longer are
+// compared directly. Keys are terminated by a 0x80 byte before padding, so keys that only differ in trailing zero bytes
+// are told apart.
+func DiffSets(a, b [][]byte) (aOnly, bOnly [][]byte) {
+	a, b = dedupe(a), dedupe(b)
+	params := diffParams(a, b)
+	if params == nil {
+		return symmetricDifference(a, b)
+	}
+	numBuckets := RecommendedBuckets(len(a) + len(b))
+	for growth := 0; growth <= maxReconcileGrowth; growth++ {
+		if aOnly, bOnly, err := diffSets(params.emptyCopy(numBuckets), a, b); err == nil {
+			return aOnly, bOnly
+		}
+		numBuckets *= 2
+	}
+	// practically unreachable, but the result must be exact
+	return symmetricDifference(a, b)
+}
+
+// ReconcileRecursive returns the keys only in localKeys and the keys only in remoteKeys, regardless of the size of the
+// difference. The keys are reconciled with filters of bucketsPerLevel buckets. If a difference cannot be decoded, the
+// keys are partitioned by the next bit of their hash and both halves are reconciled recursively, so every partition
+// eventually holds a decodable difference. Duplicate keys are ignored.
+func ReconcileRecursive(localKeys, remoteKeys [][]byte, bucketsPerLevel int) (localOnly, remoteOnly [][]byte) {
+	a, b := dedupe(localKeys), dedupe(remoteKeys)
+	params := diffParams(a, b)
+	if params == nil || bucketsPerLevel < params.K {
+		return symmetricDifference(a, b)
+	}
+	return reconcilePartition(params, a, b, bucketsPerLevel, 0)
+}
+
+// reconcilePartition reconciles the keys of a partition whose hashes share the first depth bits.
+func reconcilePartition(params *ibf, a, b [][]byte, numBuckets, depth int) (aOnly, bOnly [][]byte) {
+	if aOnly, bOnly, err := diffSets(params.emptyCopy(numBuckets), a, b); err == nil {
+		return aOnly, bOnly
+	}
+	if depth == 64 {
+		// the keys are indistinguishable by their hash
+		return symmetricDifference(a, b)
+	}
+	var aHalves, bHalves [2][][]byte
+	for _, key := range a {
+		half := params.hashKey(params.pad(terminate(key))) >> (63 - depth) & 1
+		aHalves[half] = append(aHalves[half], key)
+	}
+	for _, key := range b {
+		half := params.hashKey(params.pad(terminate(key))) >> (63 - depth) & 1
+		bHalves[half] = append(bHalves[half], key)
+	}
+	for half := range aHalves {
+		halfA, halfB := reconcilePartition(params, aHalves[half], bHalves[half], numBuckets, depth+1)
+		aOnly, bOnly = append(aOnly, halfA...), append(bOnly, halfB...)
+	}
+	return aOnly, bOnly
+}
+
+// diffParams returns an empty filter with parameters that fit the terminated keys of both sets, or nil if they are
+// longer than MaxKeyLength.
+func diffParams(a, b [][]byte) *ibf {
+	keyLength := 1
+	for _, keys := range [][][]byte{a, b} {
+		for _, key := range keys {
+			if len(key)+1 > keyLength {
+				keyLength = len(key) + 1
+			}
+		}
+	}
+	if keyLength > MaxKeyLength {
+		return nil
+	}
+	params := NewIbf(0)
+	params.KeyLength = keyLength
+	return params
+}
+
+// keyTerminator is appended to the keys of diffSets before they are zero-padded, so keys that only differ in trailing
+// zero bytes remain distinct
+const keyTerminator = 0x80
+
+// terminate returns the key followed by keyTerminator.
+func terminate(key []byte) []byte {
+	return append(append(make([]byte, 0, len(key)+1), key...), keyTerminator)
+}
+
+// unterminate strips the padding and keyTerminator of a key decoded by diffSets.
+func unterminate(key []byte) []byte {
+	end := len(key)
+	for end > 0 && key[end-1] == 0 {
+		end--
+	}
+	if end > 0 && key[end-1] == keyTerminator {
+		end--
+	}
+	return key[:end]
+}
+
+// diffSets decodes the difference of a and b using the empty filter.
+func diffSets(filter *ibf, a, b [][]byte) (aOnly, bOnly [][]byte, err error) {
+	for _, key := range a {
+		if err = filter.Add(terminate(key)); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, key := range b {
+		if err = filter.Delete(terminate(key)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if aOnly, bOnly, err = filter.Decode(); err != nil {
+		return nil, nil, err
+	}
+	for n := range aOnly {
+		aOnly[n] = unterminate(aOnly[n])
+	}
+	for n := range bOnly {
+		bOnly[n] = unterminate(bOnly[n])
+	}
+	return aOnly, bOnly, nil
+}
+
+// ThreeWayDiff classifies the keys of three filters by the sets they are in, based on the pairwise differences a-b,
+// a-c and b-c. The result maps "onlyA", "onlyB" and "onlyC" to the keys of a single set and "AB", "AC" and "BC" to
+// the keys shared by exactly two sets. None of the filters is modified.
+//
+// Subtraction cancels the keys common to both filters, so keys present in all three sets never show up in any of the
+// differences and cannot be recovered. All three differences must decode, which requires each filter to be sized for
+// the largest pairwise difference.
+func ThreeWayDiff(a, b, c *ibf) (map[string][][]byte, error) {
+	aNotB, bNotA, err := pairwiseDiff(a, b)
+	if err != nil {
+		return nil, fmt.Errorf("three-way diff failed: a-b: %w", err)
+	}
+	aNotC, cNotA, err := pairwiseDiff(a, c)
+	if err != nil {
+		return nil, fmt.Errorf("three-way diff failed: a-c: %w", err)
+	}
+	bNotC, cNotB, err := pairwiseDiff(b, c)
+	if err != nil {
+		return nil, fmt.Errorf("three-way diff failed: b-c: %w", err)
+	}
+	return map[string][][]byte{
+		"onlyA": intersect(aNotB, aNotC),
+		"onlyB": intersect(bNotA, bNotC),
+		"onlyC": intersect(cNotA, cNotB),
+		"AB":    intersect(aNotC, bNotC),
+		"AC":    intersect(aNotB, cNotB),
+		"BC":    intersect(bNotA, cNotA),
+	}, nil
+}
+
+// pairwiseDiff decodes the keys only in a and only in b from a-b without modifying either filter.
+func pairwiseDiff(a, b *ibf) (aOnly, bOnly [][]byte, err error) {
+	diff := a.clone()
+	if err = diff.Subtract(b); err != nil {
+		return nil, nil, err
+	}
+	return diff.Decode()
+}
+
+// intersect returns the keys of a that are also in b.
+func intersect(a, b [][]byte) [][]byte {
+	inB := keySet(b)
+	var both [][]byte
+	for _, key := range a {
+		if inB[string(key)] {
+			both = append(both, key)
+		}
+	}
+	return both
+}
+
+// Intersection returns the keys of a that are also in b. Subtraction cancels the shared keys, so unlike the difference
+// the intersection cannot be decoded from a-b: both filters are decoded on their own, which requires each of them to be
+// sized for all its keys, not just for the difference. Neither filter is modified.
+func Intersection(a, b *ibf) ([][]byte, error) {
+	keysA, err := a.Keys()
+	if err != nil {
+		return nil, fmt.Errorf("intersection failed: a: %w", err)
+	}
+	keysB, err := b.Keys()
+	if err != nil {
+		return nil, fmt.Errorf("intersection failed: b: %w", err)
+	}
+	return intersect(keysA, keysB), nil
+}
+
+// Union returns a new filter with the parameters of a that holds every key of a or b once. Adding the buckets of b to
+// those of a would be cheaper, but counts the keys in both filters twice, so the result is not the filter of the union
+// of the sets and merging the same filter twice is not idempotent. Union decodes both filters instead, which
+// requires each of them to be sized for all its keys. Both filters must have the same parameters, tags and insertion
+// times are not carried over. Neither filter is modified.
+func Union(a, b *ibf) (*ibf, error) {
+	if err := a.validateSubtrahend(b); err != nil {
+		return nil, fmt.Errorf("union failed: %w", err)
+	}
+	keysA, err := a.Keys()
+	if err != nil {
+		return nil, fmt.Errorf("union failed: a: %w", err)
+	}
+	keysB, err := b.Keys()
+	if err != nil {
+		return nil, fmt.Errorf("union failed: b: %w", err)
+	}
+	union := a.emptyCopy(a.Buckets.Len())
+	for _, key := range dedupe(append(keysA, keysB...)) {
+		if err = union.Add(key); err != nil {
+			return nil, fmt.Errorf("union failed: %w", err)
+		}
+	}
+	return union, nil
+}
+
+// DedupeDifference cleans up remaining and missing keys accumulated over several partial decode attempts. Duplicate
+// keys are reported once and keys that appear on both sides cancel and are dropped. The order of first appearance is
+// preserved.
+func DedupeDifference(remaining, missing [][]byte) (dedupedRemaining, dedupedMissing [][]byte) {
+	return symmetricDifference(dedupe(remaining), dedupe(missing))
+}
+
+// DiffDecodeResults returns the changes between two successive decode results, e.g. of consecutive sync rounds, so only
+// the delta has to be acted upon. Added holds the remaining and missing keys of curr that are not in prev, removed holds
+// those of prev that are not in curr. Only the keys are compared.
+func DiffDecodeResults(prev, curr DecodeResult) (added, removed DecodeResult) {
+	removed.Remaining, added.Remaining = symmetricDifference(prev.Remaining, curr.Remaining)
+	removed.Missing, added.Missing = symmetricDifference(prev.Missing, curr.Missing)
+	return added, removed
+}
+
+// CombinePartitionResults merges the decode results of filters that each cover a partition of the keys, e.g. the hash
+// ranges of AddIfInRange, into the result of the whole difference. Keys are concatenated in the order of the results,
+// Iterations and StuckCore are summed. If any partition failed, Err reports the number of failures and wraps the error
+// of the first failed partition.
+func CombinePartitionResults(results []DecodeResult) DecodeResult {
+	var combined DecodeResult
+	failed := 0
+	for _, result := range results {
+		combined.Remaining = append(combined.Remaining, result.Remaining...)
+		combined.Missing = append(combined.Missing, result.Missing...)
+		combined.Iterations += result.Iterations
+		combined.StuckCore += result.StuckCore
+		if result.Err != nil {
+			if failed == 0 {
+				combined.Err = result.Err
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		combined.Err = fmt.Errorf("(%d) of (%d) partitions failed: %w", failed, len(results), combined.Err)
+	}
+	return combined
+}
+
+// KeyStore is the external set of keys a reconciliation is applied to, e.g. a key-value store.
+type KeyStore interface {
+	Put(key []byte) error
+	Delete(key []byte) error
+}
+
+// ApplyDifference brings the store in line with the remote set after decoding local-remote: the missing keys are put
+// and the remaining keys are deleted. Pass nil remaining to only add keys. Applying stops at the first error, so the
+// store may be partially updated.
+func ApplyDifference(store KeyStore, remaining, missing [][]byte) error {
+	for _, key := range missing {
+		if err := store.Put(key); err != nil {
+			return fmt.Errorf("apply failed: put %x: %w", key, err)
+		}
+	}
+	for _, key := range remaining {
+		if err := store.Delete(key); err != nil {
+			return fmt.Errorf("apply failed: delete %x: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// dedupe returns the keys without duplicates, in order of first appearance.
+func dedupe(keys [][]byte) [][]byte {
+	seen := make(map[string]bool, len(keys))
+	var unique [][]byte
+	for _, key := range keys {
+		if !seen[string(key)] {
+			seen[string(key)] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
+
+// symmetricDifference returns the keys that are only in a and the keys that are only in b.
+func symmetricDifference(a, b [][]byte) (aOnly, bOnly [][]byte) {
+	inA, inB := keySet(a), keySet(b)
+	for _, key := range a {
+		if !inB[string(key)] {
+			aOnly = append(aOnly, key)
+		}
+	}
+	for _, key := range b {
+		if !inA[string(key)] {
+			bOnly = append(bOnly, key)
+		}
+	}
+	return aOnly, bOnly
+}
+
+func keySet(keys [][]byte) map[string]bool {
+	set := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		set[string(key)] = true
+	}
+	return set
+}
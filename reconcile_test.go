@@ -0,0 +1,516 @@
+package bloom
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// generateSets returns two key sets of size n that share the given number of keys
+func generateSets(n, shared int) (a, b [][]byte) {
+	for i := 0; i < n; i++ {
+		if i < shared {
+			key := generateData()
+			a, b = append(a, key), append(b, key)
+		} else {
+			a, b = append(a, generateData()), append(b, generateData())
+		}
+	}
+	return a, b
+}
+
+// compareKeys returns an error if actual does not contain exactly the expected keys.
+func compareKeys(expected, actual [][]byte) error {
+	exp, act := keySet(expected), keySet(actual)
+	unexpected, notFound := 0, 0
+	for key := range act {
+		if !exp[key] {
+			unexpected++
+		}
+	}
+	for key := range exp {
+		if !act[key] {
+			notFound++
+		}
+	}
+	if unexpected > 0 || notFound > 0 || len(actual) != len(act) {
+		return fmt.Errorf("expected (%d) keys got (%d): %d unexpected, %d not found", len(expected), len(actual), unexpected, notFound)
+	}
+	return nil
+}
+
+func TestCheckReconcile(t *testing.T) {
+	n := 100
+	for _, shared := range []int{0, 50, 90, 99, n} {
+		local, remote := generateSets(n, shared)
+		assert.NoError(t, CheckReconcile(local, remote, 1024), "%d shared keys", shared)
+	}
+
+	t.Run("different set sizes", func(t *testing.T) {
+		local, remote := generateSets(n, 80)
+		assert.NoError(t, CheckReconcile(local[:60], remote, 1024))
+		assert.NoError(t, CheckReconcile(nil, remote, 1024))
+	})
+
+	t.Run("undecodable", func(t *testing.T) {
+		local, remote := generateSets(n, 0)
+		assert.Error(t, CheckReconcile(local, remote, 16))
+	})
+}
+
+func TestVerifyReconciliation(t *testing.T) {
+	local, remote := generateSets(20, 15)
+	localOnly, remoteOnly := symmetricDifference(local, remote)
+
+	assert.NoError(t, VerifyReconciliation(local, remote, localOnly, remoteOnly))
+	assert.NoError(t, VerifyReconciliation(nil, nil, nil, nil))
+
+	t.Run("corrupted", func(t *testing.T) {
+		extra := generateData()
+		remaining := append([][]byte{extra, localOnly[0]}, localOnly...)
+
+		err := VerifyReconciliation(local, remote, remaining, remoteOnly[1:])
+
+		assert.EqualError(t, err, fmt.Sprintf("verification failed: remaining: false positive %x, remaining: duplicate %x, missing: false negative %x", extra, localOnly[0], remoteOnly[0]))
+	})
+
+	t.Run("swapped", func(t *testing.T) {
+		err := VerifyReconciliation(local, remote, remoteOnly, localOnly)
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), fmt.Sprintf("remaining: false positive %x", remoteOnly[0]))
+		assert.Contains(t, err.Error(), fmt.Sprintf("missing: false negative %x", remoteOnly[0]))
+	})
+}
+
+func Test_compareKeys(t *testing.T) {
+	a, b, c := generateData(), generateData(), generateData()
+
+	assert.NoError(t, compareKeys([][]byte{a, b}, [][]byte{b, a}))
+	assert.NoError(t, compareKeys(nil, nil))
+	assert.EqualError(t, compareKeys([][]byte{a, b}, [][]byte{a, c}), "expected (2) keys got (2): 1 unexpected, 1 not found")
+	assert.Error(t, compareKeys([][]byte{a}, [][]byte{a, a}), "duplicate keys")
+}
+
+func TestDiffSets(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 100; n++ {
+		size := r.Intn(200)
+		a, b := generateSets(size, r.Intn(size+1))
+		b = b[:r.Intn(size+1)]
+		// keys of any length
+		a = append(a, []byte("short"), make([]byte, 2*keyLength))
+
+		aOnly, bOnly := DiffSets(a, b)
+
+		expectedA, expectedB := symmetricDifference(a, b)
+		assert.NoError(t, compareKeys(expectedA, aOnly))
+		assert.NoError(t, compareKeys(expectedB, bOnly))
+	}
+
+	t.Run("trailing zero bytes", func(t *testing.T) {
+		aOnly, bOnly := DiffSets([][]byte{[]byte("ab")}, [][]byte{[]byte("ab\x00")})
+		assert.Equal(t, [][]byte{[]byte("ab")}, aOnly)
+		assert.Equal(t, [][]byte{[]byte("ab\x00")}, bOnly)
+
+		aOnly, bOnly = DiffSets([][]byte{{}}, [][]byte{{0}})
+		assert.Equal(t, [][]byte{{}}, aOnly)
+		assert.Equal(t, [][]byte{{0}}, bOnly)
+	})
+
+	t.Run("duplicates", func(t *testing.T) {
+		key := generateData()
+
+		aOnly, bOnly := DiffSets([][]byte{key, key}, nil)
+
+		assert.Equal(t, [][]byte{key}, aOnly)
+		assert.Empty(t, bOnly)
+	})
+}
+
+func TestReconcileRecursive(t *testing.T) {
+	local, remote := generateSets(3000, 1000)
+
+	localOnly, remoteOnly := ReconcileRecursive(local, remote, 64)
+
+	expectedLocal, expectedRemote := symmetricDifference(local, remote)
+	assert.NoError(t, compareKeys(expectedLocal, localOnly))
+	assert.NoError(t, compareKeys(expectedRemote, remoteOnly))
+
+	t.Run("trailing zero bytes", func(t *testing.T) {
+		localOnly, remoteOnly := ReconcileRecursive([][]byte{[]byte("ab")}, [][]byte{[]byte("ab\x00")}, 64)
+
+		assert.Equal(t, [][]byte{[]byte("ab")}, localOnly)
+		assert.Equal(t, [][]byte{[]byte("ab\x00")}, remoteOnly)
+	})
+
+	t.Run("too few buckets", func(t *testing.T) {
+		localOnly, remoteOnly := ReconcileRecursive(local[len(local)-10:], remote[len(remote)-10:], 2)
+
+		assert.Len(t, localOnly, 10)
+		assert.Len(t, remoteOnly, 10)
+	})
+}
+
+func TestThreeWayDiff(t *testing.T) {
+	// keys by the sets they are added to, keys in all sets cancel in every difference
+	keys := map[string][][]byte{}
+	a, b, c := NewIbf(64), NewIbf(64), NewIbf(64)
+	for _, class := range []string{"onlyA", "onlyB", "onlyC", "AB", "AC", "BC", "ABC"} {
+		for n := 0; n < 3; n++ {
+			key := generateData()
+			keys[class] = append(keys[class], key)
+			if strings.Contains(class, "A") {
+				a.Add(key)
+			}
+			if strings.Contains(class, "B") {
+				b.Add(key)
+			}
+			if strings.Contains(class, "C") {
+				c.Add(key)
+			}
+		}
+	}
+
+	result, err := ThreeWayDiff(a, b, c)
+
+	assert.NoError(t, err)
+	assert.Len(t, result, 6)
+	for class, classKeys := range result {
+		assert.NoError(t, compareKeys(keys[class], classKeys), class)
+	}
+
+	t.Run("undecodable", func(t *testing.T) {
+		for n := 0; n < 64; n++ {
+			a.Add(generateData())
+		}
+
+		_, err := ThreeWayDiff(a, b, c)
+
+		assert.Error(t, err)
+	})
+}
+
+func TestIntersection(t *testing.T) {
+	keysA, keysB := generateSets(40, 10)
+	a, b := NewIbf(128), NewIbf(128)
+	for n := range keysA {
+		a.Add(keysA[n])
+		b.Add(keysB[n])
+	}
+	expA, expB := a.clone(), b.clone()
+
+	shared, err := Intersection(a, b)
+
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, keysA[:10], shared)
+	assert.True(t, a.Equals(expA) && b.Equals(expB), "filter was modified")
+
+	t.Run("undecodable filter", func(t *testing.T) {
+		small := NewIbf(16)
+		for _, key := range keysA {
+			small.Add(key)
+		}
+
+		_, err := Intersection(a, small)
+
+		assert.ErrorIs(t, err, ErrDecodeFailed)
+	})
+}
+
+func TestUnion(t *testing.T) {
+	keysA, keysB := generateSets(40, 15)
+	a, b := NewIbf(256), NewIbf(256)
+	for n := range keysA {
+		a.Add(keysA[n])
+		b.Add(keysB[n])
+	}
+	expA, expB := a.clone(), b.clone()
+
+	union, err := Union(a, b)
+
+	assert.NoError(t, err)
+	keys, err := union.Keys()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, append(keysA, keysB[15:]...), keys)
+	assert.True(t, a.Equals(expA) && b.Equals(expB), "filter was modified")
+
+	t.Run("idempotent", func(t *testing.T) {
+		again, err := Union(union, b)
+
+		assert.NoError(t, err)
+		assert.True(t, again.Equals(union))
+	})
+
+	t.Run("different parameters", func(t *testing.T) {
+		_, err := Union(a, NewIbf(64))
+
+		assert.Error(t, err)
+	})
+
+	t.Run("undecodable filter", func(t *testing.T) {
+		small := NewIbf(256)
+		for n := 0; n < 300; n++ {
+			small.Add(generateData())
+		}
+
+		_, err := Union(a, small)
+
+		assert.ErrorIs(t, err, ErrDecodeFailed)
+	})
+}
+
+func TestDedupeDifference(t *testing.T) {
+	a, b, c, d := generateData(), generateData(), generateData(), generateData()
+
+	remaining, missing := DedupeDifference([][]byte{a, b, a, c}, [][]byte{d, c, d, c})
+
+	assert.Equal(t, [][]byte{a, b}, remaining)
+	assert.Equal(t, [][]byte{d}, missing)
+
+	remaining, missing = DedupeDifference(nil, nil)
+	assert.Empty(t, remaining)
+	assert.Empty(t, missing)
+}
+
+func TestDiffDecodeResults(t *testing.T) {
+	a, b, c, d, e := generateData(), generateData(), generateData(), generateData(), generateData()
+	prev := DecodeResult{Remaining: [][]byte{a, b}, Missing: [][]byte{c}}
+	curr := DecodeResult{Remaining: [][]byte{b, d}, Missing: [][]byte{c, e}}
+
+	added, removed := DiffDecodeResults(prev, curr)
+
+	assert.Equal(t, DecodeResult{Remaining: [][]byte{d}, Missing: [][]byte{e}}, added)
+	assert.Equal(t, DecodeResult{Remaining: [][]byte{a}}, removed)
+
+	added, removed = DiffDecodeResults(curr, curr)
+	assert.Equal(t, DecodeResult{}, added)
+	assert.Equal(t, DecodeResult{}, removed)
+}
+
+func TestCombinePartitionResults(t *testing.T) {
+	keysA, keysB := generateSets(200, 100)
+	bounds := []uint64{0, 1 << 62, 1 << 63, 3 << 62, 0}
+	var results []DecodeResult
+	for p := 0; p < 4; p++ {
+		a, b := NewIbf(128), NewIbf(128)
+		for n := range keysA {
+			_, err := a.AddIfInRange(keysA[n], bounds[p], bounds[p+1])
+			assert.NoError(t, err)
+			_, err = b.AddIfInRange(keysB[n], bounds[p], bounds[p+1])
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, a.Subtract(b))
+		results = append(results, a.DecodeFull())
+	}
+
+	combined := CombinePartitionResults(results)
+
+	assert.NoError(t, combined.Err)
+	onlyA, onlyB := symmetricDifference(keysA, keysB)
+	assert.ElementsMatch(t, onlyA, combined.Remaining)
+	assert.ElementsMatch(t, onlyB, combined.Missing)
+	assert.Equal(t, results[0].Iterations+results[1].Iterations+results[2].Iterations+results[3].Iterations, combined.Iterations)
+
+	t.Run("failed partitions", func(t *testing.T) {
+		results := append([]DecodeResult{{Err: ErrDecodeUndersized, StuckCore: 5}}, results...)
+		results = append(results, DecodeResult{Err: ErrDeadlineExceeded})
+
+		combined := CombinePartitionResults(results)
+
+		assert.ErrorIs(t, combined.Err, ErrDecodeUndersized)
+		assert.EqualError(t, combined.Err, "(2) of (6) partitions failed: decode failed: filter undersized")
+		assert.Equal(t, 5, combined.StuckCore)
+		assert.Len(t, combined.Remaining, len(onlyA))
+	})
+
+	t.Run("no results", func(t *testing.T) {
+		assert.Equal(t, DecodeResult{}, CombinePartitionResults(nil))
+	})
+}
+
+// mapStore is an in-memory KeyStore
+type mapStore map[string]bool
+
+func (m mapStore) Put(key []byte) error {
+	m[string(key)] = true
+	return nil
+}
+
+func (m mapStore) Delete(key []byte) error {
+	if !m[string(key)] {
+		return ErrKeyNotFound
+	}
+	delete(m, string(key))
+	return nil
+}
+
+func TestApplyDifference(t *testing.T) {
+	local, remote := generateSets(50, 30)
+	store := mapStore(keySet(local))
+	filter := NewIbf(256)
+	for _, key := range local {
+		filter.Add(key)
+	}
+	remoteFilter := NewIbf(256)
+	for _, key := range remote {
+		remoteFilter.Add(key)
+	}
+	assert.NoError(t, filter.Subtract(remoteFilter))
+	remaining, missing, err := filter.Decode()
+	assert.NoError(t, err)
+
+	err = ApplyDifference(store, remaining, missing)
+
+	assert.NoError(t, err)
+	assert.Equal(t, mapStore(keySet(remote)), store)
+
+	t.Run("additions only", func(t *testing.T) {
+		store := mapStore(keySet(local))
+
+		assert.NoError(t, ApplyDifference(store, nil, missing))
+		assert.Len(t, store, len(local)+len(missing))
+	})
+
+	t.Run("store error", func(t *testing.T) {
+		err := ApplyDifference(mapStore{}, [][]byte{generateData()}, nil)
+
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	})
+}
+
+func TestEstimateDifference(t *testing.T) {
+	numBuckets := 512
+	n := 2000
+	for _, shared := range []int{n, n - 10, n - 100, n - 1000, 0} {
+		local, remote := generateSets(n, shared)
+		a, b := NewIbf(numBuckets), NewIbf(numBuckets)
+		for idx := range local {
+			a.Add(local[idx])
+			b.Add(remote[idx])
+		}
+		difference := 2 * (n - shared)
+
+		estimate, err := EstimateDifference(a, b)
+
+		assert.NoError(t, err)
+		if difference < numBuckets/2 {
+			assert.Equal(t, difference, estimate, "%d shared keys", shared)
+		} else {
+			assert.InEpsilon(t, difference, estimate, 0.3, "%d shared keys", shared)
+		}
+	}
+
+	t.Run("K equals the number of buckets", func(t *testing.T) {
+		a, b := NewIbf(4), NewIbf(4)
+		a.K, b.K = 4, 4
+		for idx := 0; idx < 10; idx++ {
+			a.Add(generateData())
+		}
+
+		estimate, err := EstimateDifference(a, b)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 10, estimate)
+	})
+
+	t.Run("one-sided difference", func(t *testing.T) {
+		a, b := NewIbf(numBuckets), NewIbf(numBuckets)
+		for idx := 0; idx < n; idx++ {
+			a.Add(generateData())
+		}
+
+		estimate, err := EstimateDifference(a, b)
+
+		assert.NoError(t, err)
+		assert.InEpsilon(t, n, estimate, 0.3)
+	})
+
+	t.Run("incompatible", func(t *testing.T) {
+		_, err := EstimateDifference(NewIbf(numBuckets), NewIbf(numBuckets/2))
+		assert.Error(t, err)
+	})
+}
+
+func TestIbf_ReconcileWith(t *testing.T) {
+	local, remote := generateSets(300, 200)
+	a, b := NewIbf(32), NewIbf(32)
+	a.RetainKeys, b.RetainKeys = true, true
+	for idx := range local {
+		a.Add(local[idx])
+		b.Add(remote[idx])
+	}
+	exp := a.clone()
+	diff := a.clone()
+	assert.NoError(t, diff.Subtract(b))
+	_, _, err := diff.Decode()
+	assert.Error(t, err, "initial size should be too small")
+
+	remaining, missing, err := a.ReconcileWith(b)
+
+	assert.NoError(t, err)
+	localOnly, remoteOnly := symmetricDifference(local, remote)
+	assert.ElementsMatch(t, localOnly, remaining)
+	assert.ElementsMatch(t, remoteOnly, missing)
+	assert.True(t, a.Equals(exp), "filter was modified")
+
+	t.Run("internal decodes do not call the DecodeFailureHook", func(t *testing.T) {
+		calls := 0
+		hook := func([]byte) { calls++ }
+		a, b := a.clone(), b.clone()
+		a.DecodeFailureHook, b.DecodeFailureHook = hook, hook
+
+		_, _, err := a.ReconcileWith(b)
+
+		assert.NoError(t, err)
+		assert.Zero(t, calls)
+	})
+
+	t.Run("deleted keys are not retained", func(t *testing.T) {
+		a, b := NewIbf(32), NewIbf(32)
+		a.RetainKeys, b.RetainKeys = true, true
+		key := generateData()
+		a.Add(key)
+		a.Delete(key)
+
+		remaining, missing, err := a.ReconcileWith(b)
+
+		assert.NoError(t, err)
+		assert.Empty(t, remaining)
+		assert.Empty(t, missing)
+	})
+
+	t.Run("keys not retained", func(t *testing.T) {
+		_, _, err := NewIbf(32).ReconcileWith(b)
+		assert.Error(t, err)
+	})
+
+	t.Run("K sweep", func(t *testing.T) {
+		// fixed seed of a difference that does not decode with the default K, but does with K = 3
+		r := rand.New(rand.NewSource(2))
+		a, b := NewIbf(64), NewIbf(64)
+		a.RetainKeys, b.RetainKeys = true, true
+		for n := 0; n < 50; n++ {
+			key := make([]byte, keyLength)
+			r.Read(key)
+			a.Add(key)
+		}
+		diff := a.clone()
+		diff.Subtract(b)
+		withK3, _ := a.fromRetainedKeys(64, 3)
+		_, _, errK4 := diff.Decode()
+		_, _, errK3 := withK3.Decode()
+		assert.Error(t, errK4, "default K should fail")
+		assert.NoError(t, errK3, "K = 3 should decode")
+		a.KSweep = []int{3, 4, 5}
+
+		remaining, _, numBuckets, k, err := a.reconcileWith(b)
+
+		assert.NoError(t, err)
+		assert.Len(t, remaining, 50)
+		assert.Equal(t, 64, numBuckets, "same number of buckets")
+		assert.Equal(t, 3, k)
+	})
+}
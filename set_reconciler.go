@@ -0,0 +1,83 @@
+package bloom
+
+import "fmt"
+
+// SetReconciler reconciles sets of elements of type T, encoded as keys of up to KeyLength bytes by the encode function
+// and decoded by the decode function of its constructor. Keys are stored followed by a 0x80 byte, like the keys of
+// DiffSets, so decode receives the encoding at its original length and encodings that only differ in trailing zero
+// bytes remain distinct.
+type SetReconciler[T any] struct {
+	filter *ibf
+	encode func(T) []byte
+	decode func([]byte) (T, error)
+}
+
+// NewSetReconciler creates a SetReconciler backed by an ibf with numBuckets buckets for keys of up to keyLength bytes.
+// It fails with ErrCorruptFilter if keyLength is not between 1 and MaxKeyLength-1, the filter has a KeyLength of
+// keyLength+1 to hold the terminator. Peers must use the same numBuckets, keyLength and codec.
+func NewSetReconciler[T any](numBuckets, keyLength int, encode func(T) []byte, decode func([]byte) (T, error)) (*SetReconciler[T], error) {
+	filter, err := NewIbfWithKeyLength(numBuckets, keyLength+1)
+	if keyLength < 1 || err != nil {
+		return nil, fmt.Errorf("%w: keyLength (%d) must be between 1 and %d", ErrCorruptFilter, keyLength, MaxKeyLength-1)
+	}
+	return &SetReconciler[T]{filter: filter, encode: encode, decode: decode}, nil
+}
+
+// Add inserts the element. It fails if its encoding is longer than the key length.
+func (s *SetReconciler[T]) Add(element T) error {
+	key, err := s.key(element)
+	if err != nil {
+		return err
+	}
+	return s.filter.Add(key)
+}
+
+// Delete removes the element. It fails if its encoding is longer than the key length.
+func (s *SetReconciler[T]) Delete(element T) error {
+	key, err := s.key(element)
+	if err != nil {
+		return err
+	}
+	return s.filter.Delete(key)
+}
+
+func (s *SetReconciler[T]) key(element T) ([]byte, error) {
+	key := s.encode(element)
+	if keyLength := s.filter.KeyLength - 1; len(key) > keyLength {
+		return nil, fmt.Errorf("encoded element of (%d) bytes exceeds KeyLength (%d)", len(key), keyLength)
+	}
+	return terminate(key), nil
+}
+
+// Filter returns the underlying filter, e.g. to send it to a peer.
+func (s *SetReconciler[T]) Filter() *ibf {
+	return s.filter
+}
+
+// Diff returns the elements only in s (localOnly) and only in other (remoteOnly). Neither reconciler is modified.
+func (s *SetReconciler[T]) Diff(other *SetReconciler[T]) (localOnly, remoteOnly []T, err error) {
+	remaining, missing, err := pairwiseDiff(s.filter, other.filter)
+	if err != nil {
+		return nil, nil, fmt.Errorf("diff failed: %w", err)
+	}
+	if localOnly, err = s.decodeAll(remaining); err != nil {
+		return nil, nil, err
+	}
+	if remoteOnly, err = s.decodeAll(missing); err != nil {
+		return nil, nil, err
+	}
+	return localOnly, remoteOnly, nil
+}
+
+func (s *SetReconciler[T]) decodeAll(keys [][]byte) ([]T, error) {
+	elements := make([]T, 0, len(keys))
+	for _, key := range keys {
+		key = unterminate(key)
+		element, err := s.decode(key)
+		if err != nil {
+			return nil, fmt.Errorf("diff failed: decoding key %x: %w", key, err)
+		}
+		elements = append(elements, element)
+	}
+	return elements, nil
+}
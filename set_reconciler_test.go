@@ -0,0 +1,94 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type testUser struct {
+	ID   uint32
+	Name string
+}
+
+func encodeTestUser(u testUser) []byte {
+	key := make([]byte, 4, 4+len(u.Name))
+	binary.LittleEndian.PutUint32(key, u.ID)
+	return append(key, u.Name...)
+}
+
+func decodeTestUser(key []byte) (testUser, error) {
+	if len(key) < 4 {
+		return testUser{}, errors.New("too short")
+	}
+	return testUser{ID: binary.LittleEndian.Uint32(key), Name: string(key[4:])}, nil
+}
+
+func TestSetReconciler(t *testing.T) {
+	local, err := NewSetReconciler(64, 16, encodeTestUser, decodeTestUser)
+	assert.NoError(t, err)
+	remote, err := NewSetReconciler(64, 16, encodeTestUser, decodeTestUser)
+	assert.NoError(t, err)
+	shared, deleted := testUser{ID: 1, Name: "alice"}, testUser{ID: 2, Name: "bob"}
+	localOnly, remoteOnly := testUser{ID: 3, Name: "carol"}, testUser{ID: 4}
+	for _, u := range []testUser{shared, deleted, localOnly} {
+		assert.NoError(t, local.Add(u))
+	}
+	assert.NoError(t, local.Delete(deleted))
+	assert.NoError(t, remote.Add(shared))
+	assert.NoError(t, remote.Add(remoteOnly))
+
+	gotLocal, gotRemote, err := local.Diff(remote)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []testUser{localOnly}, gotLocal)
+	assert.Equal(t, []testUser{remoteOnly}, gotRemote)
+	assert.False(t, local.Filter().IsEmpty(), "filter was modified")
+
+	t.Run("encoding too long", func(t *testing.T) {
+		assert.Error(t, local.Add(testUser{Name: "a name longer than the key"}))
+	})
+
+	t.Run("decode error", func(t *testing.T) {
+		other, _ := NewSetReconciler(64, 16, encodeTestUser, decodeTestUser)
+		other.Filter().Add([]byte{1})
+
+		_, _, err := local.Diff(other)
+
+		assert.EqualError(t, err, "diff failed: decoding key 01: too short")
+	})
+
+	t.Run("encodings differing in trailing zero bytes", func(t *testing.T) {
+		local, _ := NewSetReconciler(64, 16, encodeTestUser, decodeTestUser)
+		remote, _ := NewSetReconciler(64, 16, encodeTestUser, decodeTestUser)
+		short, long := testUser{ID: 5, Name: "dave"}, testUser{ID: 5, Name: "dave\x00"}
+		assert.NoError(t, local.Add(short))
+		assert.NoError(t, remote.Add(long))
+
+		gotLocal, gotRemote, err := local.Diff(remote)
+
+		assert.NoError(t, err)
+		assert.Equal(t, []testUser{short}, gotLocal)
+		assert.Equal(t, []testUser{long}, gotRemote)
+	})
+
+	t.Run("encoding of KeyLength bytes", func(t *testing.T) {
+		other, _ := NewSetReconciler(64, 16, encodeTestUser, decodeTestUser)
+		full := testUser{ID: 6, Name: "twelve bytes"}
+		assert.NoError(t, other.Add(full))
+
+		_, gotRemote, err := local.Diff(other)
+
+		assert.NoError(t, err)
+		assert.Equal(t, []testUser{full}, gotRemote)
+	})
+
+	t.Run("invalid key length", func(t *testing.T) {
+		for _, keyLength := range []int{0, MaxKeyLength} {
+			_, err := NewSetReconciler(64, keyLength, encodeTestUser, decodeTestUser)
+
+			assert.ErrorIs(t, err, ErrCorruptFilter)
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package bloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// sparseIbf holds only the non-empty buckets of an ibf, which is a lot smaller for mostly empty (e.g. subtracted)
+// filters. It only supports conversion from and to the dense ibf.
+type sparseIbf struct {
+	// params is an empty filter with the parameters of the dense filter
+	params     *ibf
+	NumBuckets int
+	// Buckets maps the bucket index to the non-empty bucket
+	Buckets map[int]*Bucket
+}
+
+// ToSparse returns a sparse copy of the filter.
+func (i *ibf) ToSparse() *sparseIbf {
+	s := &sparseIbf{
+		params:     i.emptyCopy(0),
+		NumBuckets: i.Buckets.Len(),
+		Buckets:    map[int]*Bucket{},
+	}
+	for hash, length := range i.Lengths {
+		s.params.Lengths[hash] = length
+	}
+	for idx := 0; idx < i.Buckets.Len(); idx++ {
+		if b := i.Buckets.Get(idx); !b.isEmpty() {
+			s.Buckets[idx] = b.copy()
+		}
+	}
+	return s
+}
+
+// sparseIndexBytes is the size of the bucket index that precedes every bucket in a sparse encoding
+const sparseIndexBytes = 4
+
+// MarshalBinary encodes the sparse filter like the MarshalBinary of the dense ibf, but with only the non-empty buckets,
+// in order of their index and each preceded by its index.
+func (s *sparseIbf) MarshalBinary() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	order := binary.LittleEndian
+	if err := s.params.writeHeader(buf, order, s.NumBuckets, flagSparse); err != nil {
+		return nil, err
+	}
+	indices := make([]int, 0, len(s.Buckets))
+	for idx := range s.Buckets {
+		indices = append(indices, idx)
+	}
+	sort.Ints(indices)
+	if err := binary.Write(buf, order, uint32(len(indices))); err != nil {
+		return nil, err
+	}
+	entry := make([]byte, sparseIndexBytes+s.params.bucketBytes())
+	for _, idx := range indices {
+		order.PutUint32(entry, uint32(idx))
+		s.params.encodeBucket(entry[sparseIndexBytes:], s.Buckets[idx], order)
+		buf.Write(entry)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the sparse filter by the filter encoded in data by MarshalBinary.
+func (s *sparseIbf) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	params, numBuckets, order, flags, err := readHeaderFlags(r)
+	if err != nil {
+		return err
+	}
+	if flags&flagSparse == 0 {
+		return fmt.Errorf("%w: dense encoding, decode it with the ibf", ErrCorruptFilter)
+	}
+	var numEntries uint32
+	if err = binary.Read(r, order, &numEntries); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptFilter, err)
+	}
+	entrySize := sparseIndexBytes + params.bucketBytes()
+	if int64(r.Len()) != int64(numEntries)*int64(entrySize) {
+		return fmt.Errorf("%w: expected (%d) bytes of Buckets got (%d)", ErrCorruptFilter, int64(numEntries)*int64(entrySize), r.Len())
+	}
+	buckets := make(map[int]*Bucket, numEntries)
+	entry := make([]byte, entrySize)
+	previous := -1
+	for n := uint32(0); n < numEntries; n++ {
+		if _, err = io.ReadFull(r, entry); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorruptFilter, err)
+		}
+		idx := int(order.Uint32(entry))
+		if idx <= previous || idx >= numBuckets {
+			return fmt.Errorf("%w: bucket index (%d) out of order or range", ErrCorruptFilter, idx)
+		}
+		if buckets[idx], err = params.decodeBucket(entry[sparseIndexBytes:], order); err != nil {
+			return err
+		}
+		previous = idx
+	}
+	s.params, s.NumBuckets, s.Buckets = params, numBuckets, buckets
+	return nil
+}
+
+// NonEmptyBucketCount returns the number of buckets a sparse copy of the filter holds.
+func (i *ibf) NonEmptyBucketCount() int {
+	count := 0
+	for idx := 0; idx < i.Buckets.Len(); idx++ {
+		if !i.Buckets.Get(idx).isEmpty() {
+			count++
+		}
+	}
+	return count
+}
+
+// SparseBytes returns the length of the MarshalBinary encoding of ToSparse without encoding the filter, so it can be
+// compared with the TransmitCost of the dense encoding to select the smaller representation.
+func (i *ibf) SparseBytes() int {
+	return i.headerBytes() + binary.Size(uint32(0)) + i.NonEmptyBucketCount()*(sparseIndexBytes+i.bucketBytes())
+}
+
+// ToDense returns a dense copy of the filter.
+func (s *sparseIbf) ToDense() *ibf {
+	dense := s.params.emptyCopy(s.NumBuckets)
+	for hash, length := range s.params.Lengths {
+		dense.Lengths[hash] = length
+	}
+	for idx, b := range s.Buckets {
+		dense.Buckets.Set(idx, b.copy())
+	}
+	return dense
+}
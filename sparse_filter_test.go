@@ -0,0 +1,88 @@
+package bloom
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSparseIbf(t *testing.T) {
+	numBuckets := 1024
+	ibfA, ibfB := NewIbf(numBuckets), NewIbf(numBuckets)
+	for n := 0; n < 100; n++ {
+		shared := generateData()
+		ibfA.Add(shared)
+		ibfB.Add(shared)
+	}
+	ibfA.Add(generateData())
+	ibfB.Add(generateData())
+	assert.NoError(t, ibfA.Subtract(ibfB))
+
+	sparse := ibfA.ToSparse()
+	dense := sparse.ToDense()
+
+	assert.Equal(t, numBuckets, sparse.NumBuckets)
+	assert.LessOrEqual(t, len(sparse.Buckets), 2*ibfA.K, "sparse filter contains empty buckets")
+	assert.True(t, dense.Equals(ibfA), "round-trip changed the filter")
+
+	t.Run("copies buckets", func(t *testing.T) {
+		dense.Add(generateData())
+		assert.False(t, dense.Equals(ibfA))
+		assert.True(t, sparse.ToDense().Equals(ibfA))
+	})
+}
+
+func TestIbf_SparseBytes(t *testing.T) {
+	local, remote := NewIbf(1024), NewIbf(1024)
+	for n := 0; n < 500; n++ {
+		key := generateData()
+		local.Add(key)
+		remote.Add(key)
+	}
+	local.Add(generateData())
+	local.Subtract(remote)
+
+	assert.Equal(t, local.K, local.NonEmptyBucketCount())
+	data, err := local.ToSparse().MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), local.SparseBytes())
+	assert.Less(t, 50*local.SparseBytes(), local.TransmitCost())
+	data, _ = NewIbf(64).ToSparse().MarshalBinary()
+	assert.Equal(t, len(data), NewIbf(64).SparseBytes())
+}
+
+func TestSparseIbf_MarshalBinary(t *testing.T) {
+	filter := NewIbf(1024)
+	filter.PreserveLength = true
+	filter.Add(generateData()[:20])
+	for n := 0; n < 10; n++ {
+		filter.Add(generateData())
+	}
+	data, err := filter.ToSparse().MarshalBinary()
+	assert.NoError(t, err)
+
+	decoded := &sparseIbf{}
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+
+	assert.True(t, decoded.ToDense().Equals(filter), "round-trip changed the filter")
+	assert.Equal(t, filter.Lengths, decoded.ToDense().Lengths)
+
+	t.Run("dense and sparse encodings are not mixed up", func(t *testing.T) {
+		dense, _ := filter.MarshalBinary()
+
+		assert.ErrorIs(t, (&sparseIbf{}).UnmarshalBinary(dense), ErrCorruptFilter)
+		assert.ErrorIs(t, (&ibf{}).UnmarshalBinary(data), ErrCorruptFilter)
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		assert.ErrorIs(t, (&sparseIbf{}).UnmarshalBinary(data[:len(data)-1]), ErrCorruptFilter)
+		assert.ErrorIs(t, (&sparseIbf{}).UnmarshalBinary(append(data, 0)), ErrCorruptFilter)
+
+		// swap the first two entries, so the indices are out of order
+		entrySize := sparseIndexBytes + filter.bucketBytes()
+		first := len(data) - filter.NonEmptyBucketCount()*entrySize
+		swapped := append([]byte{}, data...)
+		copy(swapped[first:], data[first+entrySize:first+2*entrySize])
+		copy(swapped[first+entrySize:], data[first:first+entrySize])
+		assert.ErrorIs(t, (&sparseIbf{}).UnmarshalBinary(swapped), ErrCorruptFilter)
+	})
+}
@@ -0,0 +1,141 @@
+package bloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/spaolacci/murmur3"
+	"io"
+	"math/bits"
+)
+
+const (
+	// strataVersion is the version of the binary format of the StrataEstimator
+	strataVersion = 1
+	// strataSeed selects the stratum of a key, it differs from the seed of the strata so both are independent
+	strataSeed = uint32(defaultSeed) + 1
+)
+
+// StrataEstimator estimates the size of the difference of two sets before choosing the size of the ibf to reconcile
+// them. Keys are partitioned in strata by the number of trailing zeros of their hash, so stratum s holds about
+// 1/2^(s+1) of the keys, and every stratum is a small ibf. Estimates are decoded from the highest stratum down until a
+// stratum fails to decode, the keys recovered so far are then scaled by the fraction of keys in the decoded strata.
+// Eppstein, David, et al. "What's the difference?: efficient set reconciliation without prior context."
+type StrataEstimator struct {
+	strata []*ibf
+}
+
+// NewStrataEstimator creates an estimator with numStrata strata of bucketsPerStratum buckets. 32 strata of 80 buckets
+// estimate differences of up to billions of keys. The estimator has at least one stratum.
+func NewStrataEstimator(numStrata, bucketsPerStratum int) *StrataEstimator {
+	if numStrata < 1 {
+		numStrata = 1
+	}
+	strata := make([]*ibf, numStrata)
+	for s := range strata {
+		strata[s] = NewIbf(bucketsPerStratum)
+	}
+	return &StrataEstimator{strata: strata}
+}
+
+// Add inserts the key in its stratum.
+func (e *StrataEstimator) Add(key []byte) error {
+	return e.strata[e.stratum(key)].Add(key)
+}
+
+// stratum returns the stratum of the key.
+func (e *StrataEstimator) stratum(key []byte) int {
+	s := bits.TrailingZeros64(murmur3.Sum64WithSeed(key, strataSeed))
+	if s >= len(e.strata) {
+		s = len(e.strata) - 1
+	}
+	return s
+}
+
+// Estimate returns the estimated size of the difference of the sets in e and other. Neither estimator is modified.
+func (e *StrataEstimator) Estimate(other *StrataEstimator) (int, error) {
+	if len(e.strata) != len(other.strata) {
+		return 0, fmt.Errorf("estimate failed: unequal number of strata, expected (%d) got (%d)", len(e.strata), len(other.strata))
+	}
+	count := 0
+	for s := len(e.strata) - 1; s >= 0; s-- {
+		diff := e.strata[s].clone()
+		if err := diff.Subtract(other.strata[s]); err != nil {
+			return 0, fmt.Errorf("estimate failed: %w", err)
+		}
+		remaining, missing, err := diff.Decode()
+		if err != nil {
+			// strata s+1 and up hold 1/2^(s+1) of the keys
+			return count << (s + 1), nil
+		}
+		count += len(remaining) + len(missing)
+	}
+	return count, nil
+}
+
+// MarshalBinary encodes the estimator as its version, the number of strata and the binary encoding of each stratum
+// prefixed by its length. All integers are encoded little-endian.
+func (e *StrataEstimator) MarshalBinary() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(strataVersion)
+	if err := binary.Write(buf, binary.LittleEndian, uint32(len(e.strata))); err != nil {
+		return nil, err
+	}
+	for _, stratum := range e.strata {
+		data, err := stratum.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if err = binary.Write(buf, binary.LittleEndian, uint32(len(data))); err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the estimator by the estimator encoded in data by MarshalBinary.
+func (e *StrataEstimator) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	version, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptFilter, err)
+	}
+	if version != strataVersion {
+		return fmt.Errorf("unsupported strata estimator version (%d)", version)
+	}
+	var numStrata uint32
+	if err = binary.Read(r, binary.LittleEndian, &numStrata); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptFilter, err)
+	}
+	if numStrata == 0 {
+		return fmt.Errorf("%w: no strata", ErrCorruptFilter)
+	}
+	// every stratum takes at least its length prefix, check before allocating
+	if int64(numStrata) > int64(r.Len())/4 {
+		return fmt.Errorf("%w: (%d) strata exceed the data", ErrCorruptFilter, numStrata)
+	}
+	strata := make([]*ibf, numStrata)
+	for s := range strata {
+		var length uint32
+		if err = binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorruptFilter, err)
+		}
+		if int64(length) > int64(r.Len()) {
+			return fmt.Errorf("%w: stratum (%d) exceeds the data", ErrCorruptFilter, s)
+		}
+		stratumData := make([]byte, length)
+		if _, err = io.ReadFull(r, stratumData); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorruptFilter, err)
+		}
+		strata[s] = &ibf{}
+		if err = strata[s].UnmarshalBinary(stratumData); err != nil {
+			return err
+		}
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: (%d) trailing bytes", ErrCorruptFilter, r.Len())
+	}
+	e.strata = strata
+	return nil
+}
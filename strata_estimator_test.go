@@ -0,0 +1,68 @@
+package bloom
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStrataEstimator_Estimate(t *testing.T) {
+	for _, diffSize := range []int{0, 10, 100, 1000} {
+		a, b := NewStrataEstimator(32, 80), NewStrataEstimator(32, 80)
+		local, remote := generateSets(diffSize/2+500, 500)
+		for _, key := range local {
+			assert.NoError(t, a.Add(key))
+		}
+		for _, key := range remote {
+			assert.NoError(t, b.Add(key))
+		}
+
+		estimate, err := a.Estimate(b)
+
+		assert.NoError(t, err)
+		assert.InDelta(t, diffSize, estimate, float64(diffSize)/2+1, "difference of %d", diffSize)
+	}
+
+	t.Run("incompatible", func(t *testing.T) {
+		_, err := NewStrataEstimator(32, 80).Estimate(NewStrataEstimator(16, 80))
+
+		assert.Error(t, err)
+	})
+
+	t.Run("no strata", func(t *testing.T) {
+		a, b := NewStrataEstimator(0, 80), NewStrataEstimator(0, 80)
+		assert.NoError(t, a.Add(generateData()))
+
+		estimate, err := a.Estimate(b)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, estimate)
+		assert.Len(t, a.strata, 1)
+	})
+}
+
+func TestStrataEstimator_MarshalBinary(t *testing.T) {
+	a, b := NewStrataEstimator(32, 80), NewStrataEstimator(32, 80)
+	local, remote := generateSets(600, 500)
+	for n := range local {
+		a.Add(local[n])
+		b.Add(remote[n])
+	}
+	expected, _ := a.Estimate(b)
+
+	data, err := b.MarshalBinary()
+	assert.NoError(t, err)
+	decoded := &StrataEstimator{}
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	estimate, err := a.Estimate(decoded)
+
+	assert.NoError(t, err)
+	assert.Equal(t, expected, estimate)
+	assert.Len(t, decoded.strata, 32)
+
+	t.Run("corrupt", func(t *testing.T) {
+		assert.ErrorIs(t, (&StrataEstimator{}).UnmarshalBinary(data[:len(data)-1]), ErrCorruptFilter)
+		assert.ErrorIs(t, (&StrataEstimator{}).UnmarshalBinary(append(data, 0)), ErrCorruptFilter)
+		assert.Error(t, (&StrataEstimator{}).UnmarshalBinary([]byte{strataVersion + 1}))
+		assert.ErrorIs(t, (&StrataEstimator{}).UnmarshalBinary([]byte{strataVersion, 0, 0, 0, 0}), ErrCorruptFilter)
+	})
+}
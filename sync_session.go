@@ -0,0 +1,57 @@
+package bloom
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SyncSession runs one round of reconciliation of a local key set with a remote peer: send LocalFilter to the peer,
+// pass the filter received from the peer to ApplyRemoteFilter, and read which keys to exchange from Result. Both
+// peers must use the same number of buckets.
+type SyncSession struct {
+	local *ibf
+	// diff is the local filter minus the remote filter, nil until ApplyRemoteFilter succeeded
+	diff *ibf
+}
+
+// NewSyncSession creates a session for the local keys using a filter with numBuckets buckets.
+func NewSyncSession(keys [][]byte, numBuckets int) (*SyncSession, error) {
+	local := NewIbf(numBuckets)
+	for _, key := range keys {
+		if err := local.Add(key); err != nil {
+			return nil, fmt.Errorf("sync session failed: %w", err)
+		}
+	}
+	return &SyncSession{local: local}, nil
+}
+
+// LocalFilter returns the binary encoding of the local filter that must be sent to the peer.
+func (s *SyncSession) LocalFilter() ([]byte, error) {
+	return s.local.MarshalBinary()
+}
+
+// ApplyRemoteFilter subtracts the binary encoded filter received from the peer from the local filter.
+func (s *SyncSession) ApplyRemoteFilter(data []byte) error {
+	remote := &ibf{}
+	if err := remote.UnmarshalBinary(data); err != nil {
+		return fmt.Errorf("invalid remote filter: %w", err)
+	}
+	// the salt is never sent over the wire
+	remote.Salt = s.local.Salt
+	diff := s.local.clone()
+	if err := diff.Subtract(remote); err != nil {
+		return err
+	}
+	s.diff = diff
+	return nil
+}
+
+// Result returns the keys the peer has but we do not (wantFromRemote), and the keys we have but the peer does not
+// (sendToRemote). ApplyRemoteFilter must be called first.
+func (s *SyncSession) Result() (wantFromRemote, sendToRemote [][]byte, err error) {
+	if s.diff == nil {
+		return nil, nil, errors.New("no remote filter applied")
+	}
+	sendToRemote, wantFromRemote, err = s.diff.clone().Decode()
+	return wantFromRemote, sendToRemote, err
+}
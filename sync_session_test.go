@@ -0,0 +1,42 @@
+package bloom
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSyncSession(t *testing.T) {
+	keysA, keysB := generateSets(100, 80)
+	sessionA, err := NewSyncSession(keysA, 256)
+	assert.NoError(t, err)
+	sessionB, err := NewSyncSession(keysB, 256)
+	assert.NoError(t, err)
+
+	_, _, err = sessionA.Result()
+	assert.Error(t, err, "result without remote filter")
+
+	filterA, err := sessionA.LocalFilter()
+	assert.NoError(t, err)
+	filterB, err := sessionB.LocalFilter()
+	assert.NoError(t, err)
+	assert.NoError(t, sessionA.ApplyRemoteFilter(filterB))
+	assert.NoError(t, sessionB.ApplyRemoteFilter(filterA))
+
+	wantA, sendA, err := sessionA.Result()
+	assert.NoError(t, err)
+	wantB, sendB, err := sessionB.Result()
+	assert.NoError(t, err)
+
+	onlyA, onlyB := symmetricDifference(keysA, keysB)
+	assert.ElementsMatch(t, onlyB, wantA)
+	assert.ElementsMatch(t, onlyA, sendA)
+	assert.ElementsMatch(t, sendA, wantB)
+	assert.ElementsMatch(t, sendB, wantA)
+
+	t.Run("invalid remote filter", func(t *testing.T) {
+		assert.Error(t, sessionA.ApplyRemoteFilter([]byte{1, 2, 3}))
+		other, _ := NewSyncSession(keysB, 128)
+		filter, _ := other.LocalFilter()
+		assert.Error(t, sessionA.ApplyRemoteFilter(filter))
+	})
+}
@@ -0,0 +1,43 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// uint64KeyLength is the number of bytes of a key encoding a uint64 id
+const uint64KeyLength = 8
+
+// AddUint64s adds each id as a little-endian key of 8 bytes, zero-padded to KeyLength, so e.g. the ids of a bitmap can
+// be reconciled without converting them to keys. Use Uint64sFromKeys to convert decoded keys back to ids.
+func (i *ibf) AddUint64s(ids []uint64) error {
+	if i.KeyLength < uint64KeyLength {
+		return fmt.Errorf("KeyLength (%d) too short for uint64 keys", i.KeyLength)
+	}
+	key := make([]byte, uint64KeyLength)
+	for _, id := range ids {
+		binary.LittleEndian.PutUint64(key, id)
+		if err := i.Add(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Uint64sFromKeys converts keys decoded from a filter of uint64 ids back to the ids. It fails if a key was not added
+// by AddUint64s.
+func Uint64sFromKeys(keys [][]byte) ([]uint64, error) {
+	ids := make([]uint64, len(keys))
+	for n, key := range keys {
+		if len(key) < uint64KeyLength {
+			return nil, fmt.Errorf("key %x is not a uint64", key)
+		}
+		for _, b := range key[uint64KeyLength:] {
+			if b != 0 {
+				return nil, fmt.Errorf("key %x is not a uint64", key)
+			}
+		}
+		ids[n] = binary.LittleEndian.Uint64(key)
+	}
+	return ids, nil
+}
@@ -0,0 +1,37 @@
+package bloom
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestIbf_AddUint64s(t *testing.T) {
+	local, remote := NewIbf(64), NewIbf(64)
+	assert.NoError(t, local.AddUint64s([]uint64{1, 2, 3, math.MaxUint64}))
+	assert.NoError(t, remote.AddUint64s([]uint64{2, 3, 4}))
+	local.Subtract(remote)
+	remaining, missing, err := local.Decode()
+	assert.NoError(t, err)
+
+	localOnly, err := Uint64sFromKeys(remaining)
+	assert.NoError(t, err)
+	remoteOnly, err := Uint64sFromKeys(missing)
+	assert.NoError(t, err)
+
+	assert.ElementsMatch(t, []uint64{1, math.MaxUint64}, localOnly)
+	assert.Equal(t, []uint64{4}, remoteOnly)
+
+	t.Run("short KeyLength", func(t *testing.T) {
+		filter := NewIbf(64)
+		filter.KeyLength = 4
+
+		assert.Error(t, filter.AddUint64s([]uint64{1}))
+	})
+
+	t.Run("not a uint64", func(t *testing.T) {
+		_, err := Uint64sFromKeys([][]byte{generateData()})
+
+		assert.Error(t, err)
+	})
+}